@@ -5,22 +5,33 @@ import (
 	"os"
 	"path"
 
+	"github.com/kgaughan/sagan/internal/model"
 	"github.com/kgaughan/sagan/internal/version"
 	flag "github.com/spf13/pflag"
 )
 
 var (
-	ConfigPath   = flag.StringP("config", "c", "./sagan.yaml", "path to configuration file")
-	Workers      = flag.IntP("workers", "w", 1, "number of concurrent workers")
-	DryRun       = flag.BoolP("dry-run", "n", false, "print commands without executing them")
-	PrintVersion = flag.BoolP("version", "V", false, "print version and exit")
-	ShowHelp     = flag.BoolP("help", "h", false, "show help")
+	ConfigPath      = flag.StringP("config", "c", "./sagan.yaml", "path to configuration file")
+	Workers         = flag.IntP("workers", "w", 1, "number of concurrent workers")
+	DryRun          = flag.BoolP("dry-run", "n", false, "print commands without executing them")
+	KeepGoing       = flag.BoolP("keep-going", "k", false, "keep running tasks that don't depend on a failed task")
+	Timeout         = flag.DurationP("timeout", "t", 0, "limit on how long the whole run may take")
+	Resume          = flag.StringP("resume", "r", "", "resume the run with this ID, skipping the tasks that succeeded in it")
+	FromFailedStage = flag.Bool("from-failed-stage", false, "when resuming, start failed tasks at the stage they failed at")
+	GracePeriod     = flag.Duration("grace-period", model.DefaultGrace, "how long commands have to exit when asked to before they're killed")
+	WithDeps        = flag.Bool("with-deps", false, "also run every task the tasks given require")
+	Dependents      = flag.Bool("dependents", false, "also run every task that requires the tasks given")
+	Only            = flag.StringSlice("only", nil, "only run tasks matching these names or patterns")
+	Exclude         = flag.StringSliceP("exclude", "x", nil, "don't run tasks matching these names or patterns")
+	PrintVersion    = flag.BoolP("version", "V", false, "print version and exit")
+	ShowHelp        = flag.BoolP("help", "h", false, "show help")
 )
 
 func init() {
 	flag.Usage = func() {
 		name := path.Base(os.Args[0])
 		fmt.Fprintf(os.Stderr, "%s (v%s) - a task runner\n\n", name, version.Version)
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [task|pattern...]\n\n", name)
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		flag.PrintDefaults()
 	}
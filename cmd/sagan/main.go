@@ -3,13 +3,18 @@ package main
 import (
 	"context"
 	"fmt"
+	"maps"
 	"os"
-	"sync"
+	"path/filepath"
+	"slices"
 
-	"github.com/kgaughan/sagan/internal/common"
 	"github.com/kgaughan/sagan/internal/config"
+	"github.com/kgaughan/sagan/internal/helpers"
 	"github.com/kgaughan/sagan/internal/logging"
+	"github.com/kgaughan/sagan/internal/model"
 	"github.com/kgaughan/sagan/internal/orchestration"
+	"github.com/kgaughan/sagan/internal/state"
+	"github.com/kgaughan/sagan/internal/tfvars"
 	"github.com/kgaughan/sagan/internal/toposort"
 	"github.com/kgaughan/sagan/internal/version"
 	flag "github.com/spf13/pflag"
@@ -26,6 +31,10 @@ func main() {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if *FromFailedStage && *Resume == "" {
+		fmt.Fprintln(os.Stderr, "--from-failed-stage can only be used with --resume")
+		os.Exit(2)
+	}
 
 	cfg := &config.Config{}
 	if err := cfg.Load(*ConfigPath); err != nil {
@@ -39,10 +48,6 @@ func main() {
 	}
 
 	graph, tasks := cfg.BuildDependencyGraph()
-	if len(tasks) == 0 {
-		fmt.Fprintln(os.Stderr, "nothing to execute")
-		os.Exit(0)
-	}
 
 	// linearize to check for cycles
 	_, err := toposort.TopologicalSort(graph)
@@ -51,61 +56,156 @@ func main() {
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
+	selection := config.Selection{
+		Targets:    flag.Args(),
+		WithDeps:   *WithDeps,
+		Dependents: *Dependents,
+		Only:       *Only,
+		Exclude:    *Exclude,
+	}
+	graph, tasks, err = selection.Apply(graph, tasks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(tasks) == 0 {
+		fmt.Fprintln(os.Stderr, "nothing to execute")
+		os.Exit(0)
+	}
+
+	ctx := model.WithGrace(context.Background(), *GracePeriod)
+	ctx, cancel := model.WithTimeout(ctx, *Timeout, "run")
+	defer cancel()
+	ctx, stop := handleSignals(ctx)
+	defer stop()
 
 	logCh := make(chan logging.TaskLog, 512)
+	console := logging.NewConsole(os.Stdout)
+	drained := make(chan struct{})
 	go func() {
-		for {
-			log, ok := <-logCh
-			if !ok {
-				break
-			}
-			fmt.Printf("%v: %v\n", log.Task, log.Line)
-		}
+		console.Drain(logCh)
+		close(drained)
 	}()
 
-	sched := orchestration.NewScheduler(graph)
-
-	statuses := map[string]string{}
-	for k := range tasks {
-		statuses[k] = "waiting"
+	mgr := helpers.NewManager(cfg.Helpers, *DryRun, console, logCh)
+	for _, t := range tasks {
+		if err := mgr.Expect(t); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
 
-	env := map[string]string{}
-	var envMu sync.Mutex
-	var statusMu sync.Mutex
+	// by default, state is kept alongside the configuration
+	backend, err := state.NewBackend(cfg.State, filepath.Dir(*ConfigPath))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	store, err := state.Open(backend)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	configPath, err := filepath.Abs(*ConfigPath)
+	if err != nil {
+		configPath = *ConfigPath
+	}
+	run, err := store.NewRun(configPath, cfg.Hash(), *DryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		store.Close()
+		os.Exit(1)
+	}
+	// the tasks that succeeded in the run being resumed are carried over
+	resumed := map[string]state.TaskRun{}
+	if *Resume != "" {
+		prev, err := store.LoadRun(*Resume)
+		if err == nil {
+			err = run.Resume(prev)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			_ = run.Finish(err)
+			store.Close()
+			os.Exit(1)
+		}
+		for name := range tasks {
+			if tr, ok := prev.Task(name); ok {
+				resumed[name] = tr
+			}
+		}
+	}
+	for name := range tasks {
+		if err := run.UpdateTask(name, func(*state.TaskRun) {}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			store.Close()
+			os.Exit(1)
+		}
+	}
 
-	_, err = sched.Run(ctx, *Workers, func(name string) error {
+	sched := orchestration.NewScheduler(graph)
+	sched.KeepGoing = *KeepGoing
+	// hold back tasks whose helpers would clash with ones already running
+	sched.Admit = func(name string, force bool) bool {
 		t, ok := tasks[name]
 		if !ok {
-			return fmt.Errorf("%v: %w", name, common.ErrUnknownTask)
+			return true
 		}
-
-		// update UI: mark task running
-		statusMu.Lock()
-		statuses[name] = "running"
-		statusMu.Unlock()
-
-		// run the task
-		if err := t.Execute(ctx, cfg.Workflows, *DryRun, env, &envMu, logCh); err != nil {
-			statusMu.Lock()
-			statuses[name] = "failed"
-			statusMu.Unlock()
-			return err // nolint:wrapcheck
+		// A task scheduled again while it was running gave up what it needs
+		// when that run finished, so it's expected afresh. If that fails,
+		// running it reports why.
+		if err := mgr.Expect(t); err != nil {
+			return true
 		}
+		return mgr.Admit(t, force)
+	}
 
-		statusMu.Lock()
-		statuses[name] = "done"
-		statusMu.Unlock()
-
-		return nil
+	r := &runner{
+		cfg:             cfg,
+		tasks:           tasks,
+		dryRun:          *DryRun,
+		mgr:             mgr,
+		sched:           sched,
+		writer:          tfvars.NewWriter(),
+		fingerprints:    store.Fingerprints(),
+		run:             run,
+		logCh:           logCh,
+		resumed:         resumed,
+		fromFailedStage: *FromFailedStage,
+	}
+	sched.Blocked = r.blocked
+	_, err = sched.Run(ctx, *Workers, func(name string) error {
+		return r.exec(ctx, name)
 	})
+	mgr.Shutdown()
+	// make sure everything logged is written before reporting
+	close(logCh)
+	<-drained
+
+	if ferr := run.Finish(err); ferr != nil {
+		fmt.Fprintln(os.Stderr, ferr)
+	}
+	if cerr := store.Close(); cerr != nil {
+		fmt.Fprintln(os.Stderr, cerr)
+	}
+	fmt.Printf("final status of run %v:\n", run.ID)
+	for _, name := range slices.Sorted(maps.Keys(tasks)) {
+		tr, _ := run.Task(name)
+		retries := 0
+		for _, stage := range tr.Stages {
+			retries += len(stage.Retries)
+		}
+		switch {
+		case tr.Error != "" && tr.Status == state.StatusBlocked:
+			fmt.Printf("  %v: %v (%v)\n", name, tr.Status, tr.Error)
+		case retries > 0:
+			fmt.Printf("  %v: %v (retries: %d)\n", name, tr.Status, retries)
+		default:
+			fmt.Printf("  %v: %v\n", name, tr.Status)
+		}
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	fmt.Println("final status:")
-	for task, status := range statuses {
-		fmt.Printf("  %v: %v\n", task, status)
-	}
 }
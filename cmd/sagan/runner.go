@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/config"
+	"github.com/kgaughan/sagan/internal/helpers"
+	"github.com/kgaughan/sagan/internal/logging"
+	"github.com/kgaughan/sagan/internal/model"
+	"github.com/kgaughan/sagan/internal/orchestration"
+	"github.com/kgaughan/sagan/internal/state"
+	"github.com/kgaughan/sagan/internal/tfvars"
+)
+
+// runner runs tasks on behalf of the scheduler, recording what happens in
+// the run's state.
+type runner struct {
+	cfg    *config.Config
+	tasks  map[string]*model.Task
+	dryRun bool
+	mgr    *helpers.Manager
+	sched  *orchestration.Scheduler
+	// writer is shared as tasks running in parallel may write outputs to
+	// the same file.
+	writer       *tfvars.Writer
+	fingerprints *state.Fingerprints
+	run          *state.Run
+	logCh        chan<- logging.TaskLog
+
+	resumedMu sync.Mutex
+	// resumed holds the records of the tasks in the run being resumed that
+	// have yet to be picked up.
+	resumed map[string]state.TaskRun
+	// fromFailedStage has tasks that failed in the run being resumed start
+	// at the stage they failed at.
+	fromFailedStage bool
+}
+
+func (r *runner) log(name, line string) {
+	r.logCh <- logging.TaskLog{Task: name, Line: line}
+}
+
+// exec runs the named task.
+func (r *runner) exec(ctx context.Context, name string) error {
+	t, ok := r.tasks[name]
+	if !ok {
+		return fmt.Errorf("%v: %w", name, common.ErrUnknownTask)
+	}
+
+	// a task may be being run again after being triggered
+	if err := r.mgr.Expect(t); err != nil {
+		return err // nolint:wrapcheck
+	}
+
+	// only the first run of a task picks up from the run being resumed
+	startAt := ""
+	if prev, ok := r.pickUp(name); ok {
+		if prev.Done() {
+			r.mgr.Release(t)
+			r.log(name, fmt.Sprintf("skipping as it succeeded in run %v", r.run.Resumes))
+			return nil
+		}
+		if r.fromFailedStage {
+			startAt = prev.FailedStage()
+		}
+	}
+
+	// tasks with triggers only run when a watched field has changed
+	current, err := t.Fingerprints(r.cfg.Workflows[t.Workflow].Sources)
+	if err != nil {
+		r.mgr.Release(t)
+		return r.failed(name, err)
+	}
+	if len(t.RedeployOn) > 0 {
+		changes := r.fingerprints.Changes(name, current)
+		if len(changes) == 0 {
+			r.mgr.Release(t)
+			r.log(name, "skipping as no watched fields have changed")
+			return r.run.UpdateTask(name, func(tr *state.TaskRun) { // nolint:wrapcheck
+				tr.Status = state.StatusUnchanged
+				tr.Fingerprints = current
+			})
+		}
+		for _, c := range changes {
+			r.log(name, fmt.Sprintf("%v changed: %v -> %v", c.Key, shortHash(c.Old), shortHash(c.New)))
+		}
+	}
+
+	if err := r.run.UpdateTask(name, func(tr *state.TaskRun) {
+		*tr = state.TaskRun{
+			Status:       state.StatusRunning,
+			Started:      time.Now().UTC(),
+			Runs:         tr.Runs + 1,
+			Fingerprints: current,
+		}
+	}); err != nil {
+		r.mgr.Release(t)
+		return err // nolint:wrapcheck
+	}
+
+	// start any helpers the task needs; their values seed its environment
+	taskCtx, env, err := r.mgr.Acquire(ctx, t)
+	defer r.mgr.Release(t)
+	if err != nil {
+		return r.failed(name, err)
+	}
+	used := r.mgr.Used(t)
+	var envMu sync.Mutex
+
+	resumable := *t
+	resumable.StartAt = startAt
+	res, err := resumable.Execute(taskCtx, r.cfg.Workflows, r.dryRun, env, &envMu, r.logCh, r.writer)
+	if err != nil {
+		// report a helper dying rather than the task being killed
+		if cause := context.Cause(taskCtx); errors.Is(cause, helpers.ErrDied) {
+			err = fmt.Errorf("task %v: %w", name, cause)
+		}
+	} else if len(t.RedeployOn) > 0 && !r.dryRun {
+		err = r.fingerprints.Record(name, current)
+	}
+
+	status := state.StatusSucceeded
+	switch {
+	case errors.Is(err, common.ErrInterrupted):
+		status = state.StatusInterrupted
+	case err != nil:
+		status = state.StatusFailed
+	}
+	if serr := r.run.UpdateTask(name, func(tr *state.TaskRun) {
+		tr.Status = status
+		tr.Finished = time.Now().UTC()
+		if err != nil {
+			tr.Error = err.Error()
+		}
+		tr.Stages = stageRuns(res.Stages)
+		tr.Outputs = map[string]string{}
+		for _, u := range res.Updates {
+			tr.Outputs[u.Path+"#"+u.Field] = u.Fingerprint
+		}
+		tr.Helpers = helperRuns(used)
+	}); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return err
+	}
+
+	// run anything watching the fields the task changed after it, even if
+	// it's already run
+	for _, other := range r.cfg.Triggered(res.Updates) {
+		if _, ok := r.tasks[other.Name]; !ok {
+			r.log(name, fmt.Sprintf("not scheduling %v as it wasn't selected", other.Name))
+			continue
+		}
+		added, err := r.sched.Schedule(other.Name, name)
+		if err != nil {
+			return fmt.Errorf("task %v triggers %v: %w", name, other.Name, err)
+		}
+		if added {
+			if err := r.mgr.Expect(other); err != nil {
+				return err // nolint:wrapcheck
+			}
+			r.log(name, fmt.Sprintf("scheduling %v as a field it watches changed", other.Name))
+		}
+	}
+	return nil
+}
+
+// pickUp returns the record of the task in the run being resumed if the
+// task has yet to pick up from it.
+func (r *runner) pickUp(name string) (state.TaskRun, bool) {
+	r.resumedMu.Lock()
+	defer r.resumedMu.Unlock()
+	tr, ok := r.resumed[name]
+	delete(r.resumed, name)
+	return tr, ok
+}
+
+// blocked records a task as not being run because a task it depends on
+// failed.
+func (r *runner) blocked(name, failed string) {
+	if t, ok := r.tasks[name]; ok {
+		// it won't be needing its helpers
+		r.mgr.Release(t)
+	}
+	r.log(name, fmt.Sprintf("not running as %v failed", failed))
+	if err := r.run.UpdateTask(name, func(tr *state.TaskRun) {
+		tr.Status = state.StatusBlocked
+		tr.Error = fmt.Sprintf("blocked by %v", failed)
+	}); err != nil {
+		r.log(name, err.Error())
+	}
+}
+
+// failed records a task as having failed before it could be run.
+func (r *runner) failed(name string, err error) error {
+	if serr := r.run.UpdateTask(name, func(tr *state.TaskRun) {
+		tr.Status = state.StatusFailed
+		tr.Finished = time.Now().UTC()
+		tr.Error = err.Error()
+	}); serr != nil {
+		return serr // nolint:wrapcheck
+	}
+	return err
+}
+
+func stageRuns(results []model.StageResult) []state.StageRun {
+	stages := make([]state.StageRun, 0, len(results))
+	for _, sr := range results {
+		stage := state.StageRun{
+			Name:     sr.Name,
+			Status:   state.StatusSucceeded,
+			Started:  sr.Started.UTC(),
+			Finished: sr.Finished.UTC(),
+		}
+		switch {
+		case sr.Skipped:
+			stage.Status = state.StatusSkipped
+		case errors.Is(sr.Err, common.ErrInterrupted):
+			stage.Status = state.StatusInterrupted
+			stage.ExitCode = model.ExitCode(sr.Err)
+			stage.Error = sr.Err.Error()
+		case sr.Err != nil:
+			stage.Status = state.StatusFailed
+			stage.ExitCode = model.ExitCode(sr.Err)
+			stage.Error = sr.Err.Error()
+		}
+		for _, a := range sr.Retries {
+			stage.Retries = append(stage.Retries, state.RetryRun{
+				Command: a.Command,
+				Attempt: a.Number,
+				Error:   a.Err.Error(),
+			})
+		}
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+func helperRuns(infos []helpers.Info) []state.HelperRun {
+	runs := make([]state.HelperRun, 0, len(infos))
+	for _, info := range infos {
+		runs = append(runs, state.HelperRun{
+			Key:     info.Key,
+			Name:    info.Name,
+			Type:    info.Type,
+			Args:    info.Args,
+			PID:     info.PID,
+			Started: info.Obtained.UTC(),
+		})
+	}
+	return runs
+}
+
+// shortHash abbreviates a fingerprint for display.
+func shortHash(fp string) string {
+	if fp == "" {
+		return "none"
+	}
+	return fp[:min(len(fp), 12)]
+}
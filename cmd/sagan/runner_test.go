@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/model"
+	"github.com/kgaughan/sagan/internal/state"
+)
+
+func TestStageRuns(t *testing.T) {
+	interrupted := fmt.Errorf("command failed: %w", common.ErrInterrupted)
+	stages := stageRuns([]model.StageResult{
+		{Name: "init", Skipped: true},
+		{Name: "plan"},
+		{Name: "apply", Err: interrupted},
+		{Name: "check", Err: errors.New("failed")},
+	})
+
+	expected := []struct {
+		name, status string
+		exitCode     int
+		err          string
+	}{
+		{"init", state.StatusSkipped, 0, ""},
+		{"plan", state.StatusSucceeded, 0, ""},
+		{"apply", state.StatusInterrupted, -1, interrupted.Error()},
+		{"check", state.StatusFailed, -1, "failed"},
+	}
+	if len(stages) != len(expected) {
+		t.Fatalf("unexpected stages: %+v", stages)
+	}
+	for i, e := range expected {
+		s := stages[i]
+		if s.Name != e.name || s.Status != e.status || s.ExitCode != e.exitCode || s.Error != e.err {
+			t.Errorf("expected %+v, got %+v", e, s)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/model"
+)
+
+// handleSignals returns a context that's cancelled, with ErrInterrupted as
+// the cause, on the first SIGINT or SIGTERM, so that no further tasks are
+// started and running commands are interrupted, and that has every command
+// killed on the second. Signals aren't handled after that, so a third has its
+// usual effect. The returned function stops handling signals.
+func handleSignals(ctx context.Context) (context.Context, func()) {
+	ctx, interrupt := context.WithCancelCause(ctx)
+	kill := make(chan struct{})
+	ctx = model.WithKill(ctx, kill)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer signal.Stop(sigCh)
+		select {
+		case sig := <-sigCh:
+			fmt.Fprintf(os.Stderr, "%v: waiting for running tasks to stop; repeat to kill them\n", sig)
+			interrupt(fmt.Errorf("%w (%v)", common.ErrInterrupted, sig))
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigCh:
+			fmt.Fprintf(os.Stderr, "%v: killing running commands\n", sig)
+			close(kill)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		interrupt(context.Canceled)
+	}
+}
@@ -0,0 +1,60 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/model"
+)
+
+func TestHandleSignals(t *testing.T) {
+	ctx, stop := handleSignals(context.Background())
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the first signal to cancel the context")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, common.ErrInterrupted) {
+		t.Fatalf("expected the run to be interrupted, got %v", cause)
+	}
+	select {
+	case <-model.Killed(ctx):
+		t.Fatal("expected commands not to be killed on the first signal")
+	default:
+	}
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-model.Killed(ctx):
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second signal to kill commands")
+	}
+}
+
+func TestHandleSignalsStop(t *testing.T) {
+	ctx, stop := handleSignals(context.Background())
+	stop()
+
+	<-ctx.Done()
+	if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+		t.Fatalf("expected the context to be cancelled, got %v", cause)
+	}
+	select {
+	case <-model.Killed(ctx):
+		t.Fatal("expected commands not to be killed")
+	default:
+	}
+}
@@ -3,6 +3,19 @@ package common
 import "errors"
 
 var (
-	ErrUnknownTask     = errors.New("unknown task")
-	ErrUnknownWorkflow = errors.New("unknown workflow")
+	ErrUnknownTask      = errors.New("unknown task")
+	ErrNoMatchingTasks  = errors.New("no matching tasks")
+	ErrUnknownWorkflow  = errors.New("unknown workflow")
+	ErrUnknownHelper    = errors.New("unknown helper")
+	ErrUnknownType      = errors.New("unknown helper type")
+	ErrUnknownArgument  = errors.New("unknown helper argument")
+	ErrMissingArgument  = errors.New("missing helper argument")
+	ErrUnknownPolicy    = errors.New("unknown restart policy")
+	ErrUnknownTemporary = errors.New("unknown temporary type")
+	ErrUnknownStage     = errors.New("unknown stage")
+	ErrUnknownAction    = errors.New("unknown output action")
+	ErrNoSuchOutput     = errors.New("no such output")
+	ErrUnknownBackend   = errors.New("unknown state backend")
+	ErrInterrupted      = errors.New("interrupted")
+	ErrKilled           = errors.New("killed")
 )
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+)
+
+// Hash returns a hash of the parts of the configuration that decide which
+// tasks there are, the order they're run in, and the stages of their
+// workflows. A run can only be resumed with a configuration with the same
+// hash as the one it was started with. Other parts of the configuration,
+// such as the commands stages run, can change in between, so that whatever
+// caused the run to fail can be fixed.
+func (c *Config) Hash() string {
+	type task struct {
+		Path     string   `json:"path"`
+		Workflow string   `json:"workflow"`
+		Requires []string `json:"requires"`
+	}
+	shape := struct {
+		Tasks map[string]task `json:"tasks"`
+		// Stages maps workflows to their stages to the paths they require.
+		Stages map[string]map[string]map[string]string `json:"stages"`
+	}{
+		Tasks:  map[string]task{},
+		Stages: map[string]map[string]map[string]string{},
+	}
+	for _, t := range c.Tasks {
+		requires := slices.Clone(t.Requires)
+		slices.Sort(requires)
+		shape.Tasks[t.Name] = task{Path: t.Path, Workflow: t.Workflow, Requires: requires}
+	}
+	for name, wf := range c.Workflows {
+		stages := map[string]map[string]string{}
+		for stageName, st := range wf.Stages {
+			stages[stageName] = st.Requires
+		}
+		shape.Stages[name] = stages
+	}
+
+	// this can't fail, as it's only strings, slices, and maps keyed by strings
+	data, _ := json.Marshal(shape)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -4,9 +4,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"slices"
 
 	"github.com/kgaughan/sagan/internal/common"
 	"github.com/kgaughan/sagan/internal/model"
+	"github.com/kgaughan/sagan/internal/state"
+	"github.com/kgaughan/sagan/internal/tfvars"
+	"github.com/kgaughan/sagan/internal/toposort"
 	"go.yaml.in/yaml/v4"
 )
 
@@ -16,6 +21,7 @@ type Config struct {
 	Helpers   map[string]*model.Helper   `yaml:"helpers,omitempty"`
 	Workflows map[string]*model.Workflow `yaml:"workflows"`
 	Tasks     []*model.Task              `yaml:"tasks"`
+	State     state.Config               `yaml:"state,omitempty"`
 }
 
 // Load loads configuration from a YAML file at a given path.
@@ -37,16 +43,60 @@ func (c *Config) Load(path string) error {
 }
 
 func (c *Config) normalize() {
+	for _, wf := range c.Workflows {
+		wf.Normalize()
+	}
 	for _, p := range c.Tasks {
 		p.Normalize()
 	}
 }
 
-// ValidateConfig performs basic sanity checks on the configuration.
-// It verifies that every task references an existing workflow and that
-// every declared requirement refers to a known task name (derived from
-// the task's path).
+// Validate performs basic sanity checks on the configuration. It verifies
+// that everything referred to by name is defined, that every setting is
+// valid, and that helpers and stages can be ordered.
 func (c *Config) Validate() error {
+	for name, h := range c.Helpers {
+		switch h.Type {
+		case model.HelperDaemon, model.HelperInteractive:
+		default:
+			return fmt.Errorf("helper %q has type %q: %w", name, h.Type, common.ErrUnknownType)
+		}
+		if h.Ready != nil && h.Ready.Output != "" {
+			if _, err := regexp.Compile(h.Ready.Output); err != nil {
+				return fmt.Errorf("helper %q has an invalid readiness pattern: %w", name, err)
+			}
+		}
+		for _, cmd := range h.Commands {
+			if err := cmd.Retry.Check(); err != nil {
+				return fmt.Errorf("helper %q: %w", name, err)
+			}
+		}
+		if h.Restart != nil {
+			switch h.Restart.Policy {
+			case model.RestartNever, model.RestartOnFailure:
+			default:
+				return fmt.Errorf("helper %q has restart policy %q: %w", name, h.Restart.Policy, common.ErrUnknownPolicy)
+			}
+		}
+	}
+
+	// check for cycles between helpers
+	helperGraph := map[string][]string{}
+	for name := range c.Helpers {
+		helperGraph[name] = []string{}
+	}
+	for name, h := range c.Helpers {
+		for _, req := range h.Requires {
+			if _, ok := c.Helpers[req]; !ok {
+				return fmt.Errorf("helper %q requires %q: %w", name, req, common.ErrUnknownHelper)
+			}
+			helperGraph[req] = append(helperGraph[req], name)
+		}
+	}
+	if _, err := toposort.TopologicalSort(helperGraph); err != nil {
+		return fmt.Errorf("could not order helpers: %w", err)
+	}
+
 	// workflows presence
 	for _, p := range c.Tasks {
 		if _, ok := c.Workflows[p.Workflow]; !ok {
@@ -54,6 +104,19 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	for name, wf := range c.Workflows {
+		if err := wf.Check(); err != nil {
+			return fmt.Errorf("workflow %q: %w", name, err)
+		}
+		for _, tmp := range wf.Temporaries {
+			switch tmp.Type {
+			case model.TemporaryFile, model.TemporaryDir:
+			default:
+				return fmt.Errorf("workflow %q has temporary %q of type %q: %w", name, tmp.Name, tmp.Type, common.ErrUnknownTemporary)
+			}
+		}
+	}
+
 	// build name map for requires validation
 	names := map[string]struct{}{}
 	for _, t := range c.Tasks {
@@ -68,6 +131,31 @@ func (c *Config) Validate() error {
 				return fmt.Errorf("task %q requires %q: %w", t.Path, req, common.ErrUnknownTask)
 			}
 		}
+		for _, o := range t.Outputs {
+			switch o.Action {
+			case "", tfvars.ActionReplace, tfvars.ActionAdd:
+			default:
+				return fmt.Errorf("task %q writes %q with action %q: %w", t.Path, o.Path, o.Action, common.ErrUnknownAction)
+			}
+		}
+		for _, use := range t.Helpers {
+			if _, ok := c.Helpers[use.Name]; !ok {
+				return fmt.Errorf("task %q uses %q: %w", t.Path, use.Name, common.ErrUnknownHelper)
+			}
+			if _, err := use.Expand(c.Helpers); err != nil {
+				return fmt.Errorf("task %q uses %q: %w", t.Path, use.Name, err)
+			}
+		}
+	}
+
+	switch c.State.Backend {
+	case "", state.BackendFile:
+	case state.BackendHTTP:
+		if c.State.Address == "" {
+			return fmt.Errorf("the http state backend needs an address") // nolint:err113
+		}
+	default:
+		return fmt.Errorf("%q: %w", c.State.Backend, common.ErrUnknownBackend)
 	}
 
 	return nil
@@ -102,3 +190,19 @@ func (c Config) BuildDependencyGraph() (map[string][]string, map[string]*model.T
 
 	return graph, tasks
 }
+
+// Triggered returns the tasks with a trigger watching any of the fields
+// changed by the given updates, in the order they're configured.
+func (c Config) Triggered(updates []model.Update) []*model.Task {
+	triggered := []*model.Task{}
+	for _, t := range c.Tasks {
+		if slices.ContainsFunc(t.RedeployOn, func(tr model.Trigger) bool {
+			return slices.ContainsFunc(updates, func(u model.Update) bool {
+				return tr.Matches(t.Path, c.Workflows[t.Workflow].Sources, u)
+			})
+		}) {
+			triggered = append(triggered, t)
+		}
+	}
+	return triggered
+}
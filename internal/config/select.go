@@ -0,0 +1,212 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/model"
+)
+
+// Selection describes which tasks to run. Tasks are given by name, or by
+// glob patterns matching their names.
+type Selection struct {
+	// Targets are the tasks to run. If there are none, every task is.
+	Targets []string
+	// WithDeps adds every task the targets require, directly or
+	// indirectly.
+	WithDeps bool
+	// Dependents adds every task that requires the targets, directly or
+	// indirectly.
+	Dependents bool
+	// Only, if given, limits the tasks selected to those matching one of
+	// these.
+	Only []string
+	// Exclude removes the tasks matching any of these from those selected.
+	Exclude []string
+}
+
+// Apply narrows the dependency graph and tasks returned by
+// BuildDependencyGraph to the tasks selected. Tasks that aren't selected are
+// taken to have already run, but selected tasks that depend on each other
+// through them still run in order.
+// A name or pattern that doesn't match any task is an error, with names
+// similar to it suggested if there are any.
+func (s Selection) Apply(graph map[string][]string, tasks map[string]*model.Task) (map[string][]string, map[string]*model.Task, error) {
+	names := slices.Sorted(maps.Keys(tasks))
+
+	selected := map[string]bool{}
+	if len(s.Targets) == 0 {
+		for _, name := range names {
+			selected[name] = true
+		}
+	}
+	for _, target := range s.Targets {
+		matched, err := match(target, names)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range matched {
+			selected[name] = true
+		}
+	}
+
+	// graph maps dependencies to their dependents
+	if s.WithDeps {
+		requires := map[string][]string{}
+		for dep, dependents := range graph {
+			for _, name := range dependents {
+				requires[name] = append(requires[name], dep)
+			}
+		}
+		reach(selected, requires)
+	}
+	if s.Dependents {
+		reach(selected, graph)
+	}
+
+	if len(s.Only) > 0 {
+		only := map[string]bool{}
+		for _, pattern := range s.Only {
+			matched, err := match(pattern, names)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, name := range matched {
+				only[name] = true
+			}
+		}
+		maps.DeleteFunc(selected, func(name string, _ bool) bool { return !only[name] })
+	}
+	for _, pattern := range s.Exclude {
+		matched, err := match(pattern, names)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range matched {
+			delete(selected, name)
+		}
+	}
+
+	induced := map[string][]string{}
+	chosen := map[string]*model.Task{}
+	for name := range selected {
+		chosen[name] = tasks[name]
+		induced[name] = dependents(name, selected, graph)
+	}
+	return induced, chosen, nil
+}
+
+// dependents returns the selected tasks that depend on a task, either
+// directly or through tasks that aren't selected, so that tasks are still run
+// in order when those between them are left out.
+func dependents(name string, selected map[string]bool, graph map[string][]string) []string {
+	found := []string{}
+	seen := map[string]bool{}
+	stack := slices.Clone(graph[name])
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		if selected[n] {
+			// anything beyond it is ordered after it in turn
+			found = append(found, n)
+			continue
+		}
+		stack = append(stack, graph[n]...)
+	}
+	slices.Sort(found)
+	return found
+}
+
+// reach adds every node reachable from those already selected by following
+// edges.
+func reach(selected map[string]bool, edges map[string][]string) {
+	stack := slices.Collect(maps.Keys(selected))
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, next := range edges[n] {
+			if !selected[next] {
+				selected[next] = true
+				stack = append(stack, next)
+			}
+		}
+	}
+}
+
+// match returns the names matching a pattern, which may simply be a name.
+// It's an error for nothing to match.
+func match(pattern string, names []string) ([]string, error) {
+	if !strings.ContainsAny(pattern, `*?[\`) {
+		if slices.Contains(names, pattern) {
+			return []string{pattern}, nil
+		}
+		if similar := suggest(pattern, names); len(similar) > 0 {
+			return nil, fmt.Errorf("%q: %w; did you mean %v?", pattern, common.ErrUnknownTask, strings.Join(similar, ", "))
+		}
+		return nil, fmt.Errorf("%q: %w", pattern, common.ErrUnknownTask)
+	}
+
+	matched := []string{}
+	for _, name := range names {
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+		if ok {
+			matched = append(matched, name)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("%q: %w", pattern, common.ErrNoMatchingTasks)
+	}
+	return matched, nil
+}
+
+// suggest returns up to three names similar to one that's unknown, most
+// similar first.
+func suggest(unknown string, names []string) []string {
+	limit := max(1, len(unknown)/3)
+	distances := map[string]int{}
+	similar := []string{}
+	for _, name := range names {
+		d := distance(unknown, name)
+		if d <= limit || strings.Contains(name, unknown) {
+			distances[name] = d
+			similar = append(similar, name)
+		}
+	}
+	slices.SortStableFunc(similar, func(a, b string) int {
+		return distances[a] - distances[b]
+	})
+	return similar[:min(len(similar), 3)]
+}
+
+// distance returns the Levenshtein distance between two strings.
+func distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
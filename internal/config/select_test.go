@@ -0,0 +1,75 @@
+package config
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/model"
+)
+
+func TestSelectionApply(t *testing.T) {
+	// network <- cluster-a <- app-a, network <- cluster-b <- app-b
+	cfg := Config{Tasks: []*model.Task{
+		{Name: "network"},
+		{Name: "cluster-a", Requires: []string{"network"}},
+		{Name: "cluster-b", Requires: []string{"network"}},
+		{Name: "app-a", Requires: []string{"cluster-a"}},
+		{Name: "app-b", Requires: []string{"cluster-b"}},
+	}}
+
+	tests := []struct {
+		name      string
+		selection Selection
+		expected  []string
+	}{
+		{"everything", Selection{}, []string{"app-a", "app-b", "cluster-a", "cluster-b", "network"}},
+		{"targets", Selection{Targets: []string{"cluster-*"}}, []string{"cluster-a", "cluster-b"}},
+		{"with deps", Selection{Targets: []string{"app-a"}, WithDeps: true}, []string{"app-a", "cluster-a", "network"}},
+		{"dependents", Selection{Targets: []string{"cluster-b"}, Dependents: true}, []string{"app-b", "cluster-b"}},
+		{"only", Selection{Targets: []string{"network"}, Dependents: true, Only: []string{"*-a"}}, []string{"app-a", "cluster-a"}},
+		{"exclude", Selection{Exclude: []string{"app-*", "network"}}, []string{"cluster-a", "cluster-b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			graph, tasks, err := tt.selection.Apply(cfg.BuildDependencyGraph())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := slices.Sorted(maps.Keys(tasks)); !slices.Equal(names, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, names)
+			}
+			for from, to := range graph {
+				if _, ok := tasks[from]; !ok {
+					t.Errorf("unselected task %v in graph", from)
+				}
+				for _, name := range to {
+					if _, ok := tasks[name]; !ok {
+						t.Errorf("unselected task %v in graph", name)
+					}
+				}
+			}
+		})
+	}
+
+	// ordering through a task left out is kept
+	graph, _, err := Selection{Exclude: []string{"cluster-a"}}.Apply(cfg.BuildDependencyGraph())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(graph["network"], "app-a") {
+		t.Errorf("expected app-a to still run after network, got %v", graph)
+	}
+
+	_, _, err = Selection{Targets: []string{"netwrok"}}.Apply(cfg.BuildDependencyGraph())
+	if !errors.Is(err, common.ErrUnknownTask) || !strings.Contains(err.Error(), `did you mean network?`) {
+		t.Errorf("expected a suggestion, got %v", err)
+	}
+	_, _, err = Selection{Exclude: []string{"db-*"}}.Apply(cfg.BuildDependencyGraph())
+	if !errors.Is(err, common.ErrNoMatchingTasks) {
+		t.Errorf("expected no matching tasks, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package helpers
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/model"
+)
+
+// instance is a single helper, run with a particular set of arguments, being
+// managed on behalf of some set of tasks.
+type instance struct {
+	// key identifies the instance: it's the helper name followed by its
+	// arguments.
+	key    string
+	name   string
+	helper *model.Helper
+	args   map[string]string
+
+	// These are protected by Manager.mu.
+
+	// refs counts the pending and running tasks that need this instance.
+	refs int
+	// claims counts the tasks that have been admitted to run using this
+	// instance and haven't finished yet.
+	claims int
+
+	// mu is held while the instance is being started or stopped.
+	mu sync.Mutex
+	// idle is signalled when the last running task using the instance is
+	// done with it.
+	idle   *sync.Cond
+	active int
+	// started is only set or cleared while holding mu, but can be read
+	// without it, so that an instance being restarted doesn't hold up
+	// anything checking whether it's running.
+	started atomic.Bool
+	// restarting is set while the daemon is being restarted, and restarted
+	// is signalled once that's over, however it went.
+	restarting atomic.Bool
+	restarted  *sync.Cond
+	// abandon, if set, abandons the restart in progress. It's protected by
+	// abandonMu rather than mu, which is held while the daemon is started.
+	abandonMu sync.Mutex
+	abandon   context.CancelFunc
+	// obtained is when the instance last produced its values.
+	obtained time.Time
+	values   map[string]string
+	proc     *model.Process
+	// restarts counts how many times the daemon has been restarted after
+	// dying.
+	restarts int
+	// failed is set once the daemon has died and can't be restarted.
+	failed error
+}
+
+func newInstance(name string, helper *model.Helper, args map[string]string) *instance {
+	inst := &instance{
+		key:    instanceKey(name, args),
+		name:   name,
+		helper: helper,
+		args:   args,
+	}
+	inst.idle = sync.NewCond(&inst.mu)
+	inst.restarted = sync.NewCond(&inst.mu)
+	return inst
+}
+
+// instanceKey builds the key identifying the instance of the named helper
+// run with the given arguments.
+func instanceKey(name string, args map[string]string) string {
+	if len(args) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('[')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(args[k])
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// expired reports whether the values the instance produced have outlived the
+// helper's TTL. The caller must hold inst.mu.
+func (inst *instance) expired() bool {
+	return inst.started.Load() && inst.helper.Duration > 0 && time.Since(inst.obtained) >= inst.helper.Duration
+}
+
+// clashes reports whether this instance and another instance of the same
+// helper can't be run at the same time because they share a value for an
+// exclusive argument.
+func (inst *instance) clashes(other *instance) bool {
+	if inst == other || inst.name != other.name {
+		return false
+	}
+	for _, arg := range inst.helper.Args {
+		if arg.Exclusive && overlaps(inst.args[arg.Name], other.args[arg.Name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps reports whether two argument values clash. Values that are both
+// network prefixes clash if the ranges they cover overlap; otherwise, they
+// need to be identical.
+func overlaps(a, b string) bool {
+	if a == b {
+		return true
+	}
+	pa, errA := netip.ParsePrefix(a)
+	pb, errB := netip.ParsePrefix(b)
+	return errA == nil && errB == nil && pa.Overlaps(pb)
+}
@@ -0,0 +1,314 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/logging"
+	"github.com/kgaughan/sagan/internal/model"
+)
+
+const (
+	defaultMaxRestarts = 3
+	defaultBackoff     = time.Second
+	maxBackoff         = time.Minute
+)
+
+// start runs the helper's commands. For a daemon, the last command is left
+// running in the background until the helper is stopped. An interactive
+// helper has the terminal to itself while it runs. The caller must hold
+// inst.mu.
+func (m *Manager) start(ctx context.Context, inst *instance) error {
+	env := inst.helper.Environment(inst.args)
+	var envMu sync.Mutex
+
+	if inst.helper.Type == model.HelperInteractive {
+		if err := m.runInteractive(ctx, inst, env, &envMu); err != nil {
+			return err
+		}
+		m.started(inst, env)
+		return nil
+	}
+
+	cmds := inst.helper.Commands
+	var daemon *model.Command
+	if inst.helper.Type == model.HelperDaemon && len(cmds) > 0 {
+		daemon = &cmds[len(cmds)-1]
+		cmds = cmds[:len(cmds)-1]
+	}
+
+	var ready *readiness
+	if daemon != nil && inst.helper.Ready != nil {
+		var err error
+		if ready, err = newReadiness(inst.helper.Ready); err != nil {
+			return err
+		}
+	}
+	lines := m.relay(inst, ready)
+
+	for i, cmd := range cmds {
+		err := cmd.Retry.Do(ctx, func() error {
+			return cmd.Run(ctx, "", m.dryRun, env, &envMu, lines, inst.key)
+		}, func(a model.Attempt) {
+			m.log(inst, fmt.Sprintf("command %d failed (attempt %d of %d), retrying in %v: %v", i+1, a.Number, cmd.Retry.Retries+1, a.Wait, a.Err))
+		})
+		if err != nil {
+			close(lines)
+			return err // nolint:wrapcheck
+		}
+	}
+
+	if daemon == nil || m.dryRun {
+		close(lines)
+		m.started(inst, env)
+		return nil
+	}
+
+	// The daemon has to outlive the task that caused it to be started, so
+	// it's up to the manager to stop it. It keeps the values ctx carries,
+	// such as the grace period, including when it's restarted.
+	daemonCtx := context.WithoutCancel(ctx)
+	proc, err := daemon.Start(daemonCtx, "", env, &envMu, lines, inst.key)
+	if err != nil {
+		close(lines)
+		return err
+	}
+	inst.proc = proc
+	m.watchers.Add(1)
+	go func() {
+		defer m.watchers.Done()
+		m.watch(daemonCtx, inst, proc, lines)
+	}()
+
+	if ready != nil {
+		m.log(inst, "waiting for helper to become ready")
+		if err := ready.wait(ctx, proc, env, inst.key); err != nil {
+			inst.proc = nil
+			_ = proc.Stop()
+			return err
+		}
+		m.log(inst, "helper is ready")
+	}
+
+	m.started(inst, env)
+	return nil
+}
+
+// started records that an instance has been run. Only the values its commands
+// saved are passed on to tasks, not its arguments. The caller must hold
+// inst.mu.
+func (m *Manager) started(inst *instance, env map[string]string) {
+	inst.values = map[string]string{}
+	for _, cmd := range inst.helper.Commands {
+		if cmd.SaveAs != "" {
+			inst.values[cmd.SaveAs] = env[cmd.SaveAs]
+		}
+	}
+	inst.obtained = time.Now()
+	inst.started.Store(true)
+}
+
+// runInteractive runs the commands of an interactive helper with the terminal
+// attached, holding back the log output of everything else meanwhile.
+func (m *Manager) runInteractive(ctx context.Context, inst *instance, env map[string]string, envMu *sync.Mutex) error {
+	if !m.dryRun && m.console != nil {
+		m.console.Acquire()
+		defer m.console.Release()
+	}
+	for _, cmd := range inst.helper.Commands {
+		if err := cmd.RunInteractive(ctx, "", m.dryRun, env, envMu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relay returns a channel for a helper's commands to write their output to.
+// The output is logged as the helper's and, if there's a readiness check,
+// checked against it. The channel must be closed once nothing else can be
+// written to it.
+func (m *Manager) relay(inst *instance, ready *readiness) chan logging.TaskLog {
+	lines := make(chan logging.TaskLog)
+	m.watchers.Add(1)
+	go func() {
+		defer m.watchers.Done()
+		for line := range lines {
+			if ready != nil {
+				ready.observe(line.Line)
+			}
+			m.log(inst, line.Line)
+		}
+	}()
+	return lines
+}
+
+// watch waits for a daemon helper to exit. If it wasn't stopped deliberately,
+// the helper is restarted if its restart policy allows. Otherwise, the
+// helper has failed, as have any tasks using it. The helper is restarted
+// with ctx.
+func (m *Manager) watch(ctx context.Context, inst *instance, proc *model.Process, lines chan logging.TaskLog) {
+	err := proc.Wait()
+	close(lines)
+
+	inst.mu.Lock()
+	if inst.proc != proc {
+		// it was stopped deliberately, so however it exited is expected
+		inst.mu.Unlock()
+		m.log(inst, "stopped")
+		return
+	}
+	inst.proc = nil
+	// this is set before anything else so that Acquire waits for the restart
+	restarting := restartable(inst.helper, err)
+	inst.restarting.Store(restarting)
+	inst.mu.Unlock()
+
+	if err != nil {
+		m.log(inst, fmt.Sprintf("helper died: %v", err))
+	} else {
+		m.log(inst, "helper exited unexpectedly")
+	}
+	if restarting && m.restart(ctx, inst) {
+		return
+	}
+
+	cause := fmt.Errorf("helper %v: %w", inst.key, ErrDied)
+	inst.mu.Lock()
+	inst.failed = cause
+	inst.started.Store(false)
+	inst.values = nil
+	inst.mu.Unlock()
+
+	m.fail(inst, cause)
+}
+
+// restartable reports whether a daemon helper that exited with exitErr is to
+// be restarted.
+func restartable(helper *model.Helper, exitErr error) bool {
+	policy := helper.Restart
+	return policy != nil && policy.Policy == model.RestartOnFailure && exitErr != nil
+}
+
+// restart attempts to restart a daemon helper that has died, backing off
+// between attempts, according to its restart policy. Anything acquiring the
+// helper waits until it's done, but inst.mu isn't held while backing off, and
+// stopping the helper abandons the restart. It reports whether the helper was
+// either restarted or stopped meanwhile.
+func (m *Manager) restart(ctx context.Context, inst *instance) bool {
+	ctx, abandon := context.WithCancel(ctx)
+	inst.abandonMu.Lock()
+	inst.abandon = abandon
+	inst.abandonMu.Unlock()
+	defer func() {
+		inst.abandonMu.Lock()
+		inst.abandon = nil
+		inst.abandonMu.Unlock()
+		abandon()
+	}()
+
+	policy := inst.helper.Restart
+	maxRestarts := policy.MaxRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = defaultMaxRestarts
+	}
+	backoff := policy.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	inst.mu.Lock()
+	defer func() {
+		inst.restarting.Store(false)
+		inst.restarted.Broadcast()
+		inst.mu.Unlock()
+	}()
+	for i := 0; i < inst.restarts; i++ {
+		backoff = min(backoff*2, maxBackoff)
+	}
+	for inst.restarts < maxRestarts {
+		inst.restarts++
+		m.log(inst, fmt.Sprintf("restarting in %v (attempt %d of %d)", backoff, inst.restarts, maxRestarts))
+		inst.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-model.Killed(ctx):
+			inst.mu.Lock()
+			m.log(inst, "giving up on restarting helper as commands are being killed")
+			return false
+		case <-time.After(backoff):
+		}
+		inst.mu.Lock()
+		// it may have been stopped before there was a restart to abandon
+		if ctx.Err() != nil || !inst.started.Load() {
+			return true
+		}
+		err := m.start(ctx, inst)
+		if err == nil || ctx.Err() != nil {
+			return true
+		}
+		m.log(inst, fmt.Sprintf("could not restart helper: %v", err))
+		backoff = min(backoff*2, maxBackoff)
+	}
+	m.log(inst, "giving up on restarting helper")
+	return false
+}
+
+// fail cancels every running task using an instance that has failed.
+func (m *Manager) fail(inst *instance, cause error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, acquired := range m.held {
+		for _, other := range acquired {
+			if other == inst {
+				m.logTask(name, fmt.Sprintf("failing: %v", cause))
+				m.cancels[name](cause)
+				break
+			}
+		}
+	}
+}
+
+// log writes a line to the log on behalf of a helper instance.
+func (m *Manager) log(inst *instance, line string) {
+	if m.logCh != nil {
+		m.logCh <- logging.TaskLog{Helper: inst.key, Line: line}
+	}
+}
+
+// logTask writes a line to the log on behalf of a task.
+func (m *Manager) logTask(name, line string) {
+	if m.logCh != nil {
+		m.logCh <- logging.TaskLog{Task: name, Line: line}
+	}
+}
+
+// stop tears down a helper instance if it's running, abandoning any restart
+// in progress.
+func (m *Manager) stop(inst *instance) {
+	inst.abandonMu.Lock()
+	if inst.abandon != nil {
+		inst.abandon()
+	}
+	inst.abandonMu.Unlock()
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	m.teardown(inst)
+}
+
+// teardown stops the instance's daemon, if any, and discards its values. The
+// caller must hold inst.mu.
+func (m *Manager) teardown(inst *instance) {
+	if !inst.started.Load() {
+		return
+	}
+	if inst.proc != nil {
+		proc := inst.proc
+		// clear it first so the exit isn't mistaken for a crash
+		inst.proc = nil
+		_ = proc.Stop()
+	}
+	inst.started.Store(false)
+	inst.values = nil
+}
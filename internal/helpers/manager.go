@@ -0,0 +1,327 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/logging"
+	"github.com/kgaughan/sagan/internal/model"
+)
+
+// ErrNotExpected is returned when acquiring helpers for a task the manager
+// wasn't told to expect.
+var ErrNotExpected = errors.New("task was not expected")
+
+// Manager starts the helpers tasks need and tears them down once no task
+// that's still waiting to run or is running needs them any more.
+type Manager struct {
+	helpers map[string]*model.Helper
+	dryRun  bool
+	console *logging.Console
+	logCh   chan<- logging.TaskLog
+
+	mu sync.Mutex
+	// instances maps instance keys to instances.
+	instances map[string]*instance
+	// order holds the instances in the order they were created, which is
+	// always after any instances they require.
+	order []*instance
+	// needs tracks the instances each task expected to run needs.
+	needs map[string][]*instance
+	// admitted tracks the instances each admitted task has claimed.
+	admitted map[string][]*instance
+	// held tracks the instances each running task has acquired.
+	held map[string][]*instance
+	// cancels holds the functions to cancel each running task if one of its
+	// helpers fails.
+	cancels map[string]context.CancelCauseFunc
+	// blocked tracks the instance each held back task was last reported as
+	// waiting on.
+	blocked map[string]string
+
+	// watchers tracks the goroutines watching and relaying the output of
+	// helpers, so Shutdown can wait for them to finish logging.
+	watchers sync.WaitGroup
+}
+
+// NewManager creates a Manager for the given helper definitions. Interactive
+// helpers are given exclusive use of the console while they run.
+func NewManager(helpers map[string]*model.Helper, dryRun bool, console *logging.Console, logCh chan<- logging.TaskLog) *Manager {
+	return &Manager{
+		helpers:   helpers,
+		dryRun:    dryRun,
+		console:   console,
+		logCh:     logCh,
+		instances: map[string]*instance{},
+		needs:     map[string][]*instance{},
+		admitted:  map[string][]*instance{},
+		held:      map[string][]*instance{},
+		cancels:   map[string]context.CancelCauseFunc{},
+		blocked:   map[string]string{},
+	}
+}
+
+// Expect records that a task will be run, so the helpers it needs must be
+// kept around until it's done with them. It must be called for every task
+// before the first one is admitted or acquired, and again before a task is
+// run another time. Expecting a task that's already expected does nothing.
+func (m *Manager) Expect(t *model.Task) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.needs[t.Name]; ok {
+		return nil
+	}
+	need := []*instance{}
+	seen := map[*instance]bool{}
+	for _, use := range t.Helpers {
+		expanded, err := use.Expand(m.helpers)
+		if err != nil {
+			return fmt.Errorf("task %q uses %q: %w", t.Name, use.Name, err)
+		}
+		for _, ex := range expanded {
+			key := instanceKey(ex.Name, ex.Args)
+			inst, ok := m.instances[key]
+			if !ok {
+				inst = newInstance(ex.Name, m.helpers[ex.Name], ex.Args)
+				m.instances[key] = inst
+				m.order = append(m.order, inst)
+			}
+			if !seen[inst] {
+				seen[inst] = true
+				inst.refs++
+				need = append(need, inst)
+			}
+		}
+	}
+	m.needs[t.Name] = need
+	return nil
+}
+
+// Admit reports whether a task can start without any of the helper instances
+// it needs clashing with a live instance of the same helper. If it can, the
+// instances are claimed for the task until it's released. If the task is
+// held back, the instance it's waiting on is logged.
+//
+// If force is set, nothing else is running, so any idle instance in the way
+// is torn down early to let the task go ahead, even if some task still to run
+// needs it or it's being restarted.
+func (m *Manager) Admit(t *model.Task, force bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	need := m.needs[t.Name]
+	for _, inst := range need {
+		for _, other := range m.instances {
+			if !inst.clashes(other) || !m.live(other) {
+				continue
+			}
+			if force && other.claims == 0 {
+				m.log(other, fmt.Sprintf("stopping early to make way for %v", inst.key))
+				m.stop(other)
+				continue
+			}
+			if m.blocked[t.Name] != other.key {
+				m.blocked[t.Name] = other.key
+				m.logTask(t.Name, fmt.Sprintf("waiting for helper %v to be torn down before starting %v", other.key, inst.key))
+			}
+			return false
+		}
+	}
+
+	for _, inst := range need {
+		inst.claims++
+	}
+	m.admitted[t.Name] = need
+	delete(m.blocked, t.Name)
+	return true
+}
+
+// live reports whether an instance is running or about to be. It doesn't wait
+// on inst.mu, which is held while a daemon is being started. The caller must
+// hold m.mu.
+func (m *Manager) live(inst *instance) bool {
+	return inst.claims > 0 || inst.started.Load()
+}
+
+// Acquire starts any helpers the task needs that aren't already running and
+// returns the values they've made available to the task. Helpers whose values
+// have outlived their TTL are re-run first, but a daemon helper is never
+// restarted while another task is still using it: Acquire waits for them to
+// finish instead.
+//
+// The task should be run with the returned context, which is cancelled if any
+// of its helpers dies and can't be restarted.
+func (m *Manager) Acquire(ctx context.Context, t *model.Task) (context.Context, map[string]string, error) {
+	for {
+		taskCtx, values, busy, err := m.acquire(ctx, t)
+		if err != nil {
+			return ctx, nil, err
+		}
+		if busy == nil {
+			return taskCtx, values, nil
+		}
+		// Wait without holding on to anything else, so that a task waiting
+		// on us can't be waiting on it.
+		busy.mu.Lock()
+		for busy.expired() && busy.proc != nil && busy.active > 0 {
+			busy.idle.Wait()
+		}
+		busy.mu.Unlock()
+	}
+}
+
+// acquire makes a single attempt at acquiring the helpers a task needs,
+// returning the context to run the task with. If an expired daemon helper
+// can't be refreshed because it's in use, everything acquired so far is given
+// up and the busy instance is returned.
+func (m *Manager) acquire(ctx context.Context, t *model.Task) (context.Context, map[string]string, *instance, error) {
+	values := map[string]string{}
+	m.mu.Lock()
+	need, ok := m.needs[t.Name]
+	m.mu.Unlock()
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("task %q: %w", t.Name, ErrNotExpected)
+	}
+	acquired := make([]*instance, 0, len(need))
+
+	for _, inst := range need {
+		inst.mu.Lock()
+		for inst.restarting.Load() {
+			inst.restarted.Wait()
+		}
+		if inst.failed != nil {
+			inst.mu.Unlock()
+			m.giveUp(acquired)
+			return nil, nil, nil, inst.failed
+		}
+		if inst.expired() {
+			if inst.proc != nil && inst.active > 0 {
+				inst.mu.Unlock()
+				m.giveUp(acquired)
+				return nil, nil, inst, nil
+			}
+			m.log(inst, "values have expired, refreshing")
+			m.teardown(inst)
+		}
+		if !inst.started.Load() {
+			if err := m.start(ctx, inst); err != nil {
+				inst.mu.Unlock()
+				m.giveUp(acquired)
+				return nil, nil, nil, fmt.Errorf("could not start helper %v for task %v: %w", inst.key, t.Name, err)
+			}
+		}
+		inst.active++
+		acquired = append(acquired, inst)
+		maps.Copy(values, inst.values)
+		inst.mu.Unlock()
+	}
+
+	// the task can be failed as soon as it's holding its helpers
+	taskCtx, cancel := context.WithCancelCause(ctx)
+	m.mu.Lock()
+	m.held[t.Name] = acquired
+	m.cancels[t.Name] = cancel
+	m.mu.Unlock()
+	return taskCtx, values, nil, nil
+}
+
+// Info describes a helper instance.
+type Info struct {
+	Key  string
+	Name string
+	Type string
+	Args map[string]string
+	// PID is the process ID of a running daemon helper.
+	PID int
+	// Obtained is when the instance last produced its values.
+	Obtained time.Time
+}
+
+// Used describes the helper instances a running task has acquired.
+func (m *Manager) Used(t *model.Task) []Info {
+	m.mu.Lock()
+	acquired := slices.Clone(m.held[t.Name])
+	m.mu.Unlock()
+
+	infos := make([]Info, 0, len(acquired))
+	for _, inst := range acquired {
+		inst.mu.Lock()
+		info := Info{
+			Key:      inst.key,
+			Name:     inst.name,
+			Type:     inst.helper.Type,
+			Args:     maps.Clone(inst.args),
+			Obtained: inst.obtained,
+		}
+		if inst.proc != nil {
+			info.PID = inst.proc.PID()
+		}
+		inst.mu.Unlock()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// giveUp marks the given instances as no longer in use by a task.
+func (m *Manager) giveUp(acquired []*instance) {
+	for _, inst := range acquired {
+		inst.mu.Lock()
+		inst.active--
+		if inst.active == 0 {
+			inst.idle.Broadcast()
+		}
+		inst.mu.Unlock()
+	}
+}
+
+// Release records that a task no longer needs its helpers, whether or not it
+// ran successfully. Any helper no other task needs is torn down.
+func (m *Manager) Release(t *model.Task) {
+	m.mu.Lock()
+	acquired := m.held[t.Name]
+	delete(m.held, t.Name)
+	for _, inst := range m.admitted[t.Name] {
+		inst.claims--
+	}
+	delete(m.admitted, t.Name)
+	delete(m.blocked, t.Name)
+	need := m.needs[t.Name]
+	delete(m.needs, t.Name)
+	if cancel, ok := m.cancels[t.Name]; ok {
+		cancel(nil)
+		delete(m.cancels, t.Name)
+	}
+	m.mu.Unlock()
+	m.giveUp(acquired)
+
+	// tear down in reverse so helpers outlive the helpers requiring them
+	for i := len(need) - 1; i >= 0; i-- {
+		inst := need[i]
+		m.mu.Lock()
+		inst.refs--
+		idle := inst.refs <= 0
+		m.mu.Unlock()
+
+		if idle {
+			m.stop(inst)
+		}
+	}
+}
+
+// Shutdown tears down every helper that's still running, each before any
+// helper it requires. Once it returns, helpers won't log anything further.
+func (m *Manager) Shutdown() {
+	m.mu.Lock()
+	instances := slices.Clone(m.order)
+	m.mu.Unlock()
+
+	for i := len(instances) - 1; i >= 0; i-- {
+		m.stop(instances[i])
+	}
+	m.watchers.Wait()
+}
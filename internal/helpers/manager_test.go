@@ -0,0 +1,391 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/logging"
+	"github.com/kgaughan/sagan/internal/model"
+)
+
+// daemon defines a daemon helper that runs the given command.
+func daemon(command string) *model.Helper {
+	return &model.Helper{
+		Type:     model.HelperDaemon,
+		Commands: []model.Command{{Command: command}},
+	}
+}
+
+// task defines a task using a helper with the given arguments.
+func task(name, helper string, args map[string]string) *model.Task {
+	return &model.Task{Name: name, Helpers: []model.Invocation{{Name: helper, Args: args}}}
+}
+
+// expect has the manager expect each of the tasks.
+func expect(t *testing.T, m *Manager, tasks ...*model.Task) {
+	t.Helper()
+	for _, task := range tasks {
+		if err := m.Expect(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReleaseTearsDownUnneededHelpers(t *testing.T) {
+	m := NewManager(map[string]*model.Helper{"tunnel": daemon("exec sleep 30")}, false, nil, nil)
+	defer m.Shutdown()
+	a, b := task("a", "tunnel", nil), task("b", "tunnel", nil)
+	expect(t, m, a, b)
+
+	for _, task := range []*model.Task{a, b} {
+		if _, _, err := m.Acquire(context.Background(), task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inst := m.instances["tunnel"]
+
+	m.Release(a)
+	if !inst.started.Load() {
+		t.Fatal("expected the helper to be kept for b")
+	}
+	m.Release(b)
+	if inst.started.Load() || inst.proc != nil {
+		t.Fatal("expected the helper to be torn down")
+	}
+}
+
+func TestClashes(t *testing.T) {
+	tunnel := &model.Helper{Args: []model.Argument{{Name: "cidr", Exclusive: true}, {Name: "name"}}}
+	tests := []struct {
+		a, b    string
+		clashes bool
+	}{
+		{"10.0.0.0/16", "10.0.0.0/16", true},
+		{"10.0.0.0/16", "10.0.1.0/24", true},
+		{"10.0.0.0/16", "10.1.0.0/16", false},
+		{"eu", "eu", true},
+		{"eu", "us", false},
+	}
+	for _, tt := range tests {
+		a := newInstance("tunnel", tunnel, map[string]string{"cidr": tt.a, "name": "a"})
+		b := newInstance("tunnel", tunnel, map[string]string{"cidr": tt.b, "name": "b"})
+		if a.clashes(b) != tt.clashes {
+			t.Errorf("%v and %v: expected clashes to be %v", tt.a, tt.b, tt.clashes)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer that's safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p) // nolint:wrapcheck
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestInteractiveHelperHoldsBackLogs(t *testing.T) {
+	started := filepath.Join(t.TempDir(), "started")
+	login := &model.Helper{
+		Type:     model.HelperInteractive,
+		Commands: []model.Command{{Command: "touch " + started + "; sleep 0.3; echo token", SaveAs: "TOKEN"}},
+	}
+	var out syncBuffer
+	console := logging.NewConsole(&out)
+	logCh := make(chan logging.TaskLog)
+	go console.Drain(logCh)
+	defer close(logCh)
+	m := NewManager(map[string]*model.Helper{"login": login}, false, console, logCh)
+	defer m.Shutdown()
+	a := task("a", "login", nil)
+	expect(t, m, a)
+
+	acquired := make(chan map[string]string, 1)
+	go func() {
+		_, values, err := m.Acquire(context.Background(), a)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- values
+	}()
+	for {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	logCh <- logging.TaskLog{Task: "b", Line: "busy"}
+	// once this is received, the line before it has been dealt with
+	logCh <- logging.TaskLog{Task: "b", Line: "still busy"}
+	if strings.Contains(out.String(), "b: busy") {
+		t.Fatal("expected the log to be held back while the helper has the terminal")
+	}
+
+	values := <-acquired
+	if values["TOKEN"] != "token" {
+		t.Fatalf("unexpected values: %v", values)
+	}
+	if !strings.Contains(out.String(), "b: busy\n") {
+		t.Fatalf("expected the log to be written once the helper was done, got %q", out.String())
+	}
+	m.Release(a)
+}
+
+func TestAdmitHoldsBackClashes(t *testing.T) {
+	tunnel := daemon("exec sleep 30")
+	tunnel.Args = []model.Argument{{Name: "cidr", Exclusive: true}, {Name: "name"}}
+	m := NewManager(map[string]*model.Helper{"tunnel": tunnel}, false, nil, nil)
+	defer m.Shutdown()
+	// a and c share an instance, while b's overlaps with it
+	a := task("a", "tunnel", map[string]string{"cidr": "10.0.0.0/16", "name": "x"})
+	b := task("b", "tunnel", map[string]string{"cidr": "10.0.1.0/24", "name": "y"})
+	c := task("c", "tunnel", map[string]string{"cidr": "10.0.0.0/16", "name": "x"})
+	expect(t, m, a, b, c)
+
+	if !m.Admit(a, false) {
+		t.Fatal("expected a to be admitted")
+	}
+	if _, _, err := m.Acquire(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	if m.Admit(b, true) {
+		t.Fatal("expected b to be held back while a is running")
+	}
+
+	// the instance is idle, but c still needs it
+	m.Release(a)
+	if m.Admit(b, false) {
+		t.Fatal("expected b to be held back while a's helper is running")
+	}
+	if !m.Admit(b, true) {
+		t.Fatal("expected b to be admitted when forced")
+	}
+	if m.instances[instanceKey("tunnel", a.Helpers[0].Args)].started.Load() {
+		t.Fatal("expected a's helper to be torn down to make way for b")
+	}
+	m.Release(b)
+	m.Release(c)
+}
+
+func TestAcquireWaitsToRefreshHelperInUse(t *testing.T) {
+	tunnel := daemon("exec sleep 30")
+	tunnel.Duration = 100 * time.Millisecond
+	m := NewManager(map[string]*model.Helper{"tunnel": tunnel}, false, nil, nil)
+	defer m.Shutdown()
+	a, b := task("a", "tunnel", nil), task("b", "tunnel", nil)
+	expect(t, m, a, b)
+
+	if _, _, err := m.Acquire(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	inst := m.instances["tunnel"]
+	first := inst.proc
+	time.Sleep(2 * tunnel.Duration)
+
+	acquired := make(chan error, 1)
+	go func() {
+		_, _, err := m.Acquire(context.Background(), b)
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("expected b to wait for a to finish, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	m.Release(a)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected b to acquire the helper once a was done")
+	}
+	inst.mu.Lock()
+	refreshed := inst.proc != first
+	inst.mu.Unlock()
+	if !refreshed {
+		t.Fatal("expected the helper to have been restarted")
+	}
+	m.Release(b)
+}
+
+func TestAcquireReadinessTimeout(t *testing.T) {
+	tunnel := daemon("exec sleep 30")
+	tunnel.Ready = &model.Readiness{
+		Path:     t.TempDir() + "/never",
+		Timeout:  200 * time.Millisecond,
+		Interval: 20 * time.Millisecond,
+	}
+	m := NewManager(map[string]*model.Helper{"tunnel": tunnel}, false, nil, nil)
+	defer m.Shutdown()
+	a := task("a", "tunnel", nil)
+	expect(t, m, a)
+
+	_, _, err := m.Acquire(context.Background(), a)
+	if !errors.Is(err, ErrNotReady) {
+		t.Fatalf("expected the helper not to become ready, got %v", err)
+	}
+	if m.instances["tunnel"].proc != nil {
+		t.Fatal("expected the helper to be stopped")
+	}
+	m.Release(a)
+}
+
+func TestHelperDyingFailsTask(t *testing.T) {
+	tunnel := daemon("sleep 0.2; exit 1")
+	tunnel.Restart = &model.RestartPolicy{
+		Policy:      model.RestartOnFailure,
+		MaxRestarts: 1,
+		Backoff:     10 * time.Millisecond,
+	}
+	m := NewManager(map[string]*model.Helper{"tunnel": tunnel}, false, nil, nil)
+	defer m.Shutdown()
+	a := task("a", "tunnel", nil)
+	expect(t, m, a)
+
+	ctx, _, err := m.Acquire(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the task to be failed")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, ErrDied) {
+		t.Fatalf("expected the helper to have died, got %v", cause)
+	}
+	inst := m.instances["tunnel"]
+	inst.mu.Lock()
+	restarts := inst.restarts
+	inst.mu.Unlock()
+	if restarts != 1 {
+		t.Fatalf("expected the helper to be restarted once, got %v", restarts)
+	}
+	m.Release(a)
+}
+
+// dying defines a daemon helper that dies shortly after it's started and
+// waits a long time before being restarted.
+func dying() *model.Helper {
+	tunnel := daemon("sleep 0.1; exit 1")
+	tunnel.Restart = &model.RestartPolicy{
+		Policy:  model.RestartOnFailure,
+		Backoff: time.Minute,
+	}
+	return tunnel
+}
+
+// waitForRestart waits until the instance is being restarted.
+func waitForRestart(t *testing.T, inst *instance) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !inst.restarting.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the helper to be restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReleaseAbandonsRestart(t *testing.T) {
+	m := NewManager(map[string]*model.Helper{"tunnel": dying()}, false, nil, nil)
+	defer m.Shutdown()
+	a := task("a", "tunnel", nil)
+	expect(t, m, a)
+
+	if _, _, err := m.Acquire(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	inst := m.instances["tunnel"]
+	waitForRestart(t, inst)
+
+	released := make(chan struct{})
+	go func() {
+		m.Release(a)
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the helper to be torn down without waiting for the restart")
+	}
+	m.watchers.Wait()
+	if inst.started.Load() || inst.proc != nil || inst.restarting.Load() {
+		t.Fatal("expected the restart to be abandoned")
+	}
+}
+
+func TestForcedAdmitStopsRestart(t *testing.T) {
+	tunnel := dying()
+	tunnel.Args = []model.Argument{{Name: "cidr", Exclusive: true}}
+	m := NewManager(map[string]*model.Helper{"tunnel": tunnel}, false, nil, nil)
+	defer m.Shutdown()
+	// c still needs a's instance once a is done, while b's clashes with it
+	a := task("a", "tunnel", map[string]string{"cidr": "10.0.0.0/16"})
+	b := task("b", "tunnel", map[string]string{"cidr": "10.0.1.0/24"})
+	c := task("c", "tunnel", map[string]string{"cidr": "10.0.0.0/16"})
+	expect(t, m, a, b, c)
+
+	if !m.Admit(a, false) {
+		t.Fatal("expected a to be admitted")
+	}
+	if _, _, err := m.Acquire(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	waitForRestart(t, m.instances[instanceKey("tunnel", a.Helpers[0].Args)])
+	m.Release(a)
+
+	if m.Admit(b, false) {
+		t.Fatal("expected b to be held back while a's helper is being restarted")
+	}
+	if !m.Admit(b, true) {
+		t.Fatal("expected b to be admitted when forced")
+	}
+	m.Release(b)
+	m.Release(c)
+}
+
+func TestKillAbandonsRestart(t *testing.T) {
+	m := NewManager(map[string]*model.Helper{"tunnel": dying()}, false, nil, nil)
+	defer m.Shutdown()
+	a := task("a", "tunnel", nil)
+	expect(t, m, a)
+
+	kill := make(chan struct{})
+	ctx, _, err := m.Acquire(model.WithKill(context.Background(), kill), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRestart(t, m.instances["tunnel"])
+	close(kill)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the task to be failed")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, ErrDied) {
+		t.Fatalf("expected the helper to have died, got %v", cause)
+	}
+	m.Release(a)
+}
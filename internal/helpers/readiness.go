@@ -0,0 +1,132 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/logging"
+	"github.com/kgaughan/sagan/internal/model"
+)
+
+const (
+	defaultReadyTimeout  = 30 * time.Second
+	defaultReadyInterval = 250 * time.Millisecond
+)
+
+var (
+	ErrNotReady = errors.New("helper did not become ready")
+	ErrExited   = errors.New("helper exited before becoming ready")
+	ErrDied     = errors.New("helper died")
+)
+
+// readiness tracks whether a daemon helper has met the conditions for being
+// considered ready.
+type readiness struct {
+	ready   *model.Readiness
+	pattern *regexp.Regexp
+	// matched is set once a line of output matches the pattern.
+	matched atomic.Bool
+}
+
+func newReadiness(ready *model.Readiness) (*readiness, error) {
+	r := &readiness{ready: ready}
+	if ready.Output != "" {
+		pattern, err := regexp.Compile(ready.Output)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readiness pattern: %w", err)
+		}
+		r.pattern = pattern
+	}
+	return r, nil
+}
+
+// observe checks a line of the helper's output against the readiness
+// pattern.
+func (r *readiness) observe(line string) {
+	if r.pattern != nil && r.pattern.MatchString(line) {
+		r.matched.Store(true)
+	}
+}
+
+// wait blocks until the helper is ready, it exits, or the timeout passes.
+func (r *readiness) wait(ctx context.Context, proc *model.Process, env map[string]string, name string) error {
+	timeout := r.ready.Timeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+	interval := r.ready.Interval
+	if interval <= 0 {
+		interval = defaultReadyInterval
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if r.check(ctx, env, name) {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-proc.Done():
+			return ErrExited
+		case <-deadline.C:
+			return fmt.Errorf("%w within %v", ErrNotReady, timeout)
+		case <-ctx.Done():
+			return ctx.Err() // nolint:wrapcheck
+		}
+	}
+}
+
+// check reports whether every readiness condition is currently met.
+func (r *readiness) check(ctx context.Context, env map[string]string, name string) bool {
+	if r.pattern != nil && !r.matched.Load() {
+		return false
+	}
+	if r.ready.Address != "" {
+		conn, err := net.DialTimeout("tcp", expand(r.ready.Address, env), time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	if r.ready.Path != "" {
+		if _, err := os.Stat(expand(r.ready.Path, env)); err != nil {
+			return false
+		}
+	}
+	if r.ready.Probe != "" {
+		// the probe is run repeatedly, so its output is just noise
+		discard := make(chan logging.TaskLog)
+		go func() {
+			for range discard {
+			}
+		}()
+		defer close(discard)
+		probe := model.Command{Command: r.ready.Probe}
+		var envMu sync.Mutex
+		if err := probe.Run(ctx, "", false, env, &envMu, discard, name); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// expand substitutes environment variables in s, preferring those in env.
+func expand(s string, env map[string]string) string {
+	return os.Expand(s, func(name string) string {
+		if val, ok := env[name]; ok {
+			return val
+		}
+		return os.Getenv(name)
+	})
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Console writes task log lines to the terminal. Something needing to
+// interact with the user can take exclusive use of the terminal, during which
+// log lines are held back and written once it's done.
+type Console struct {
+	out io.Writer
+
+	// term is held by whatever has exclusive use of the terminal.
+	term sync.Mutex
+
+	mu      sync.Mutex
+	held    bool
+	pending []TaskLog
+}
+
+// NewConsole creates a Console writing to out.
+func NewConsole(out io.Writer) *Console {
+	return &Console{out: out}
+}
+
+// Drain writes log lines received from logCh until it's closed.
+func (c *Console) Drain(logCh <-chan TaskLog) {
+	for log := range logCh {
+		c.mu.Lock()
+		if c.held {
+			c.pending = append(c.pending, log)
+		} else {
+			c.write(log)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Acquire takes exclusive use of the terminal, holding back log lines until
+// Release is called. It blocks while anything else has the terminal.
+func (c *Console) Acquire() {
+	c.term.Lock()
+	c.mu.Lock()
+	c.held = true
+	c.mu.Unlock()
+}
+
+// Release gives up exclusive use of the terminal and writes out any log lines
+// that were held back in the meantime.
+func (c *Console) Release() {
+	c.mu.Lock()
+	for _, log := range c.pending {
+		c.write(log)
+	}
+	c.pending = nil
+	c.held = false
+	c.mu.Unlock()
+	c.term.Unlock()
+}
+
+func (c *Console) write(log TaskLog) {
+	if log.Helper != "" {
+		fmt.Fprintf(c.out, "helper %v: %v\n", log.Helper, log.Line)
+	} else {
+		fmt.Fprintf(c.out, "%v: %v\n", log.Task, log.Line)
+	}
+}
@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConsoleHoldsBackLogs(t *testing.T) {
+	var out bytes.Buffer
+	c := NewConsole(&out)
+	logCh := make(chan TaskLog)
+	drained := make(chan struct{})
+	go func() {
+		c.Drain(logCh)
+		close(drained)
+	}()
+
+	logCh <- TaskLog{Task: "a", Line: "before"}
+	c.Acquire()
+	logCh <- TaskLog{Task: "a", Line: "during"}
+	// once this is received, the line before it has been dealt with
+	logCh <- TaskLog{Helper: "tunnel", Line: "also during"}
+	c.mu.Lock()
+	written := out.String()
+	c.mu.Unlock()
+	if strings.Contains(written, "during") {
+		t.Fatalf("expected lines to be held back, got %q", written)
+	}
+
+	c.Release()
+	close(logCh)
+	<-drained
+	expected := "a: before\na: during\nhelper tunnel: also during\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+}
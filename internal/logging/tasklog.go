@@ -1,7 +1,9 @@
 package logging
 
-// TaskLog represents a single line of log output associated with a task.
+// TaskLog represents a single line of log output associated with a task, or
+// with a helper if Helper is set.
 type TaskLog struct {
-	Task string
-	Line string
+	Task   string
+	Helper string
+	Line   string
 }
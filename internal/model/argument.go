@@ -2,8 +2,10 @@ package model
 
 // Argument represents some value that a helper expects to be available.
 type Argument struct {
-	Name      string `yaml:"name"`
-	Default   string `yaml:"default,omitempty"`
-	Exclusive bool   `yaml:"exclusive"`
-	Variable  string `yaml:"env,omitempty"`
+	Name string `yaml:"name"`
+	// Default is the value the argument has if none is given. It's nil if
+	// there's none, so that an empty default can be told apart from that.
+	Default   *string `yaml:"default,omitempty"`
+	Exclusive bool    `yaml:"exclusive"`
+	Variable  string  `yaml:"env,omitempty"`
 }
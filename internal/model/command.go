@@ -3,13 +3,18 @@ package model
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"maps"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/kgaughan/sagan/internal/common"
 	"github.com/kgaughan/sagan/internal/logging"
 )
 
@@ -17,14 +22,40 @@ import (
 type Command struct {
 	Command string `yaml:"cmd"`
 	SaveAs  string `yaml:"save_as,omitempty"`
+	// Timeout limits how long the command may run, if positive.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Retry is how the command is retried if it fails.
+	Retry RetryPolicy `yaml:",inline"`
 }
 
+// Process is a command that has been started and may still be running.
+type Process struct {
+	cmd *exec.Cmd
+	// stop has the process asked to exit.
+	stop      context.CancelFunc
+	stopping  atomic.Bool
+	streams   sync.WaitGroup
+	captureMu sync.Mutex
+	capture   bytes.Buffer
+	// output holds everything written to stdout and stderr.
+	output bytes.Buffer
+	// detached is set once the process has exited and anything it left
+	// behind is no longer listened to.
+	detached bool
+	done     chan struct{}
+	err      error
+}
+
+// drainDelay is how long a process's output is still read for once it's
+// exited, as anything it left running in the background may hold on to it.
+const drainDelay = 100 * time.Millisecond
+
 // Run executes a single command string through the shell. If Command.SaveAs
 // is set, stdout is captured and stored in an environment variable with that
-// name for subsequent commands.
+// name for subsequent commands. If the command fails, the error is a
+// CommandError giving everything it wrote. It's only run once: it's up to the
+// caller to follow Command.Retry.
 func (c Command) Run(ctx context.Context, workdir string, dryRun bool, env map[string]string, envMu *sync.Mutex, logCh chan<- logging.TaskLog, taskName string) error {
-	shell := "sh"
-	arg := "-c"
 	if dryRun {
 		// do not execute, but mimic SaveAs by setting empty value
 		if c.SaveAs != "" {
@@ -34,6 +65,181 @@ func (c Command) Run(ctx context.Context, workdir string, dryRun bool, env map[s
 		}
 		return nil
 	}
+
+	ctx, cancel := WithTimeout(ctx, c.Timeout, "command")
+	defer cancel()
+	proc, err := c.Start(ctx, workdir, env, envMu, logCh, taskName)
+	if err != nil {
+		return err
+	}
+	if err := proc.Wait(); err != nil {
+		return &CommandError{Err: stopped(ctx, err), Output: proc.CombinedOutput()}
+	}
+
+	if c.SaveAs != "" {
+		val := strings.TrimSpace(proc.Output())
+		// persist in provided env map for subsequent commands
+		envMu.Lock()
+		env[c.SaveAs] = val
+		envMu.Unlock()
+	}
+
+	return nil
+}
+
+// Start launches a command string through the shell without waiting for it
+// to finish. Its output is streamed to logCh as it's produced. If ctx is
+// cancelled, the command and anything it started are asked to exit. It's done
+// once the command exits, even if something it left running in the
+// background still holds its output open.
+func (c Command) Start(ctx context.Context, workdir string, env map[string]string, envMu *sync.Mutex, logCh chan<- logging.TaskLog, taskName string) (*Process, error) {
+	ctx, cancel := withKill(ctx)
+	cmd := c.prepare(ctx, workdir, env, envMu)
+	exited := isolate(ctx, cmd, func(line string) {
+		if logCh != nil {
+			logCh <- logging.TaskLog{Task: taskName, Line: line}
+		} else {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	})
+
+	// The pipes are our own rather than from StdoutPipe and StderrPipe so
+	// that Wait returns once the command exits, even if something it left
+	// running in the background still holds them open.
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		cancel()
+		return nil, err // nolint:wrapcheck
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		cancel()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err // nolint:wrapcheck
+	}
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	err = cmd.Start()
+	// only the command needs the write ends
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		cancel()
+		stdoutR.Close()
+		stderrR.Close()
+		return nil, err // nolint:wrapcheck
+	}
+
+	p := &Process{cmd: cmd, stop: cancel, done: make(chan struct{})}
+	p.streams.Add(2)
+	go p.captureStream(stdoutR, true, logCh, taskName)
+	go p.captureStream(stderrR, false, logCh, taskName)
+
+	go func() {
+		p.err = cmd.Wait()
+		if p.stopping.Load() && cmd.ProcessState != nil && cmd.ProcessState.Success() {
+			// it exited cleanly when asked to
+			p.err = nil
+		}
+		exited()
+		drained := make(chan struct{})
+		go func() {
+			p.streams.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(drainDelay):
+			// Whatever's still writing is left to it, but the pipes are
+			// kept drained so that it doesn't get SIGPIPE.
+			p.captureMu.Lock()
+			p.detached = true
+			p.captureMu.Unlock()
+		}
+		cancel()
+		close(p.done)
+	}()
+
+	return p, nil
+}
+
+// ExitCode returns the exit code of the command that caused err, -1 if err
+// wasn't caused by a command exiting, or 0 if there's no error.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// Capture executes a command string through the shell and returns what it
+// wrote to stdout. Unlike with Run, the output isn't logged. If the command
+// fails, what it wrote to stderr is included in the error.
+func (c Command) Capture(ctx context.Context, workdir string, env map[string]string, envMu *sync.Mutex) (string, error) {
+	ctx, cancel := WithTimeout(ctx, c.Timeout, "command")
+	defer cancel()
+	ctx, stop := withKill(ctx)
+	defer stop()
+	cmd := c.prepare(ctx, workdir, env, envMu)
+	exited := isolate(ctx, cmd, nil)
+	out, err := cmd.Output()
+	exited()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", stopped(ctx, err)
+	}
+	return string(out), nil
+}
+
+// RunInteractive executes a command string through the shell with the
+// terminal attached so that it can prompt the user. If Command.SaveAs is set,
+// stdout is captured rather than shown and stored as with Run. The caller is
+// responsible for ensuring nothing else writes to the terminal meanwhile.
+func (c Command) RunInteractive(ctx context.Context, workdir string, dryRun bool, env map[string]string, envMu *sync.Mutex) error {
+	if dryRun {
+		return c.Run(ctx, workdir, dryRun, env, envMu, nil, "")
+	}
+
+	// it stays in the terminal's process group so that it can read from it
+	ctx, cancel := WithTimeout(ctx, c.Timeout, "command")
+	defer cancel()
+	cmd := c.prepare(ctx, workdir, env, envMu)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	var capture bytes.Buffer
+	if c.SaveAs != "" {
+		cmd.Stdout = &capture
+	} else {
+		cmd.Stdout = os.Stdout
+	}
+
+	if err := cmd.Run(); err != nil {
+		return stopped(ctx, err)
+	}
+
+	if c.SaveAs != "" {
+		envMu.Lock()
+		env[c.SaveAs] = strings.TrimSpace(capture.String())
+		envMu.Unlock()
+	}
+
+	return nil
+}
+
+// prepare creates the shell invocation for the command, with the parent
+// process's environment overlaid with env.
+func (c Command) prepare(ctx context.Context, workdir string, env map[string]string, envMu *sync.Mutex) *exec.Cmd {
+	shell := "sh"
+	arg := "-c"
 	// gosec freaks out about this, but it's 100% intentional. The whole point
 	// of this is to run arbitrary commands.
 	cmd := exec.CommandContext(ctx, shell, arg, c.Command) // #nosec: G204
@@ -60,63 +266,151 @@ func (c Command) Run(ctx context.Context, workdir string, dryRun bool, env map[s
 	}
 	cmd.Env = finalEnv
 
-	// Prepare pipes to stream output
-	stdoutPipe, err := cmd.StdoutPipe()
-	if err != nil {
-		return err // nolint:wrapcheck
+	return cmd
+}
+
+// isolate puts the command in a process group of its own so that, when ctx
+// is cancelled, it and anything it started are asked to exit. If they were
+// interrupted, they're sent SIGINT and given as long as they need to exit;
+// otherwise, they're sent SIGTERM and killed if they're still running once
+// the grace period has passed. If they're to be killed, they're killed
+// straight away. Once a command that was stopped has exited, anything it
+// left behind in the group is killed.
+//
+// The returned function must be called once the command has been waited on.
+// If the group had to be killed after the grace period, that's reported using
+// report, if given, at that point.
+func isolate(ctx context.Context, cmd *exec.Cmd, report func(string)) func() {
+	setProcessGroup(cmd)
+	grace := gracePeriod(ctx)
+	exited := make(chan struct{})
+	var overdue atomic.Bool
+	cmd.Cancel = func() error {
+		var timer <-chan time.Time
+		var err error
+		switch cause := context.Cause(ctx); {
+		case errors.Is(cause, common.ErrKilled):
+			return killGroup(cmd)
+		case errors.Is(cause, common.ErrInterrupted):
+			err = interruptGroup(cmd)
+		default:
+			err = terminateGroup(cmd)
+			timer = time.After(grace)
+		}
+		go func() {
+			select {
+			case <-timer:
+				overdue.Store(true)
+			case <-Killed(ctx):
+			case <-exited:
+				return
+			}
+			_ = killGroup(cmd)
+		}()
+		return err
 	}
-	stderrPipe, err := cmd.StderrPipe()
-	if err != nil {
-		return err // nolint:wrapcheck
+	return func() {
+		close(exited)
+		if ctx.Err() == nil {
+			return
+		}
+		// Anything left behind in the group is killed without being
+		// reported, as processes that have exited but have yet to be reaped
+		// can't be told apart from those still running.
+		_ = killGroup(cmd)
+		if overdue.Load() && report != nil {
+			report(fmt.Sprintf("killed process group %d as it was still running %v after being asked to exit", cmd.Process.Pid, grace))
+		}
 	}
+}
 
-	if err := cmd.Start(); err != nil {
-		return err // nolint:wrapcheck
+// stopped wraps err with the reason ctx was cancelled, such as the limit
+// that fired or the command being interrupted, if there's one.
+func stopped(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil && cause != ctx.Err() { // nolint:errorlint
+		return fmt.Errorf("%w: %w", cause, err)
 	}
+	return err
+}
 
-	var captureMu sync.Mutex
-	var capture bytes.Buffer
-	go captureStream(stdoutPipe, &captureMu, capture, logCh, taskName)
-	go captureStream(stderrPipe, &captureMu, capture, logCh, taskName)
+// Wait blocks until the process exits, returning its exit status.
+func (p *Process) Wait() error {
+	<-p.done
+	return p.err
+}
 
-	if err := cmd.Wait(); err != nil {
-		return err // nolint:wrapcheck
-	}
+// Done returns a channel that's closed once the process has exited.
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
 
-	if c.SaveAs != "" {
-		val := strings.TrimSpace(capture.String())
-		// persist in provided env map for subsequent commands
-		envMu.Lock()
-		env[c.SaveAs] = val
-		envMu.Unlock()
-	}
+// PID returns the process's ID.
+func (p *Process) PID() int {
+	return p.cmd.Process.Pid
+}
 
-	return nil
+// Output returns what the process has written to stdout so far.
+func (p *Process) Output() string {
+	p.captureMu.Lock()
+	defer p.captureMu.Unlock()
+	return p.capture.String()
 }
 
-func captureStream(stream io.ReadCloser, captureMu *sync.Mutex, capture bytes.Buffer, logCh chan<- logging.TaskLog, taskName string) {
+// CombinedOutput returns what the process has written to stdout and stderr
+// so far.
+func (p *Process) CombinedOutput() string {
+	p.captureMu.Lock()
+	defer p.captureMu.Unlock()
+	return p.output.String()
+}
+
+// Stop asks the process and anything it started to exit with SIGTERM,
+// killing them outright if they're still running once the grace period has
+// passed, and waits for the process to exit.
+func (p *Process) Stop() error {
+	p.stopping.Store(true)
+	p.stop()
+	<-p.done
+	return p.err
+}
+
+func (p *Process) captureStream(stream io.ReadCloser, capture bool, logCh chan<- logging.TaskLog, taskName string) {
+	defer p.streams.Done()
+	defer stream.Close()
 	buf := make([]byte, 1024)
 	for {
 		n, err := stream.Read(buf)
 		if n > 0 {
-			chunk := string(buf[:n])
-			captureMu.Lock()
-			capture.WriteString(chunk)
-			captureMu.Unlock()
-			if logCh != nil {
-				lines := strings.Split(chunk, "\n")
-				for i, l := range lines {
-					if i == len(lines)-1 && l == "" {
-						continue
-					}
-					logCh <- logging.TaskLog{Task: taskName, Line: l}
-				}
-			} else {
-				os.Stderr.Write([]byte(chunk))
-			}
+			p.record(string(buf[:n]), capture, logCh, taskName)
 		}
 		if err != nil {
 			break
 		}
 	}
 }
+
+// record captures and logs a chunk of output, unless the process is no
+// longer listened to. It's logged while holding p.captureMu so that nothing
+// is logged once that's the case.
+func (p *Process) record(chunk string, capture bool, logCh chan<- logging.TaskLog, taskName string) {
+	p.captureMu.Lock()
+	defer p.captureMu.Unlock()
+	if p.detached {
+		return
+	}
+	if capture {
+		p.capture.WriteString(chunk)
+	}
+	p.output.WriteString(chunk)
+	if logCh != nil {
+		lines := strings.Split(chunk, "\n")
+		for i, l := range lines {
+			if i == len(lines)-1 && l == "" {
+				continue
+			}
+			logCh <- logging.TaskLog{Task: taskName, Line: l}
+		}
+	} else {
+		os.Stderr.Write([]byte(chunk))
+	}
+}
@@ -0,0 +1,87 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunTimeout(t *testing.T) {
+	// the child keeps the output open, so the whole group has to go
+	cmd := Command{Command: "sleep 30 & wait", Timeout: 100 * time.Millisecond}
+	var envMu sync.Mutex
+
+	started := time.Now()
+	err := cmd.Run(context.Background(), t.TempDir(), false, map[string]string{}, &envMu, nil, "")
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if timeout.Limit != cmd.Timeout {
+		t.Fatalf("unexpected limit: %v", timeout.Limit)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("took %v to stop", elapsed)
+	}
+}
+
+func TestRunTimeoutNamesOuterLimit(t *testing.T) {
+	ctx, cancel := WithTimeout(context.Background(), 100*time.Millisecond, "stage apply")
+	defer cancel()
+	var envMu sync.Mutex
+
+	err := Command{Command: "sleep 30", Timeout: time.Minute}.Run(ctx, t.TempDir(), false, map[string]string{}, &envMu, nil, "")
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) || timeout.What != "stage apply" {
+		t.Fatalf("expected the stage to time out, got %v", err)
+	}
+}
+
+func TestRunLeavesBackgroundProcess(t *testing.T) {
+	// the child keeps the output open after the command has exited
+	cmd := Command{Command: "sleep 3 & echo hi", SaveAs: "OUT"}
+	env := map[string]string{}
+	var envMu sync.Mutex
+
+	started := time.Now()
+	if err := cmd.Run(context.Background(), t.TempDir(), false, env, &envMu, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("took %v to return", elapsed)
+	}
+	if env["OUT"] != "hi" {
+		t.Fatalf("unexpected output: %q", env["OUT"])
+	}
+}
+
+func TestRunInteractiveSavesOutput(t *testing.T) {
+	cmd := Command{Command: "echo token", SaveAs: "TOKEN"}
+	env := map[string]string{}
+	var envMu sync.Mutex
+
+	if err := cmd.RunInteractive(context.Background(), t.TempDir(), false, env, &envMu); err != nil {
+		t.Fatal(err)
+	}
+	if env["TOKEN"] != "token" {
+		t.Fatalf("unexpected output: %q", env["TOKEN"])
+	}
+}
+
+func TestRunKillsStragglers(t *testing.T) {
+	// the child ignores SIGTERM and keeps the output open
+	cmd := Command{Command: "(trap '' TERM; sleep 30) & wait", Timeout: 100 * time.Millisecond}
+	ctx := WithGrace(context.Background(), 200*time.Millisecond)
+	var envMu sync.Mutex
+
+	started := time.Now()
+	err := cmd.Run(ctx, t.TempDir(), false, map[string]string{}, &envMu, nil, "")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("took %v to stop", elapsed)
+	}
+}
@@ -1,13 +1,66 @@
 package model
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+// Helper types.
+const (
+	// HelperDaemon is a helper whose last command is kept running in the
+	// background for as long as tasks need it.
+	HelperDaemon = "daemon"
+	// HelperInteractive is a one-shot helper that is given the terminal so it
+	// can prompt the user.
+	HelperInteractive = "interactive"
+)
 
 // Helper represents a set of command executed to do things such as manage a
 // tunnel, fetch credentials, &c., needed by the workflows.
 type Helper struct {
-	Type     string        `yaml:"type"`
-	Requires []string      `yaml:"requires,omitempty"`
-	Args     []Argument    `yaml:"args,omitempty"`
-	Commands []Command     `yaml:"run"`
-	Duration time.Duration `yaml:"ttl,omitempty"`
+	Type     string         `yaml:"type"`
+	Requires []string       `yaml:"requires,omitempty"`
+	Args     []Argument     `yaml:"args,omitempty"`
+	Commands []Command      `yaml:"run"`
+	Duration time.Duration  `yaml:"ttl,omitempty"`
+	Ready    *Readiness     `yaml:"ready,omitempty"`
+	Restart  *RestartPolicy `yaml:"restart,omitempty"`
+}
+
+// Resolve works out the full set of arguments the helper is to be run with
+// given the values supplied by a task, filling in defaults. Every argument
+// must end up with a value. Values for arguments the helper doesn't have are
+// ignored.
+func (h Helper) Resolve(values map[string]string) (map[string]string, error) {
+	args := map[string]string{}
+	for _, arg := range h.Args {
+		if val, ok := values[arg.Name]; ok {
+			args[arg.Name] = val
+		} else if arg.Default != nil {
+			args[arg.Name] = *arg.Default
+		} else {
+			return nil, fmt.Errorf("%q: %w", arg.Name, common.ErrMissingArgument)
+		}
+	}
+	return args, nil
+}
+
+// Environment returns the environment variables the helper's commands are to
+// be run with for the given resolved arguments. Each argument is available
+// under its own name and, if it has one, under the name of its variable.
+func (h Helper) Environment(args map[string]string) map[string]string {
+	env := map[string]string{}
+	for _, arg := range h.Args {
+		val, ok := args[arg.Name]
+		if !ok {
+			continue
+		}
+		env[arg.Name] = val
+		if arg.Variable != "" {
+			env[arg.Variable] = val
+		}
+	}
+	return env
 }
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"errors"
+	"maps"
+	"testing"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"go.yaml.in/yaml/v4"
+)
+
+func TestResolve(t *testing.T) {
+	var tunnel Helper
+	if err := yaml.Unmarshal([]byte(`
+type: daemon
+args:
+  - name: cidr
+    default: 192.168.0.0/16
+  - name: environment
+  - name: suffix
+    default: ""
+`), &tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		values   map[string]string
+		expected map[string]string
+		err      error
+	}{
+		{
+			name:     "defaults",
+			values:   map[string]string{"environment": "prod"},
+			expected: map[string]string{"cidr": "192.168.0.0/16", "environment": "prod", "suffix": ""},
+		},
+		{
+			name:     "given",
+			values:   map[string]string{"cidr": "10.0.0.0/8", "environment": "prod", "suffix": "-b"},
+			expected: map[string]string{"cidr": "10.0.0.0/8", "environment": "prod", "suffix": "-b"},
+		},
+		{
+			name:     "others ignored",
+			values:   map[string]string{"environment": "prod", "region": "us-east-1"},
+			expected: map[string]string{"cidr": "192.168.0.0/16", "environment": "prod", "suffix": ""},
+		},
+		{
+			name:   "missing",
+			values: map[string]string{"cidr": "10.0.0.0/8"},
+			err:    common.ErrMissingArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := tunnel.Resolve(tt.values)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if !maps.Equal(args, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+// DefaultGrace is how long a command that's been asked to exit has to do so
+// before it's killed, unless a context says otherwise.
+const DefaultGrace = 10 * time.Second
+
+type (
+	killKey  struct{}
+	graceKey struct{}
+)
+
+// WithGrace returns a context carrying how long commands started with it,
+// or any context derived from it, have to exit after being asked to before
+// they're killed.
+func WithGrace(ctx context.Context, grace time.Duration) context.Context {
+	return context.WithValue(ctx, graceKey{}, grace)
+}
+
+// gracePeriod returns how long commands started with ctx have to exit after
+// being asked to.
+func gracePeriod(ctx context.Context) time.Duration {
+	if grace, ok := ctx.Value(graceKey{}).(time.Duration); ok && grace > 0 {
+		return grace
+	}
+	return DefaultGrace
+}
+
+// WithKill returns a context carrying kill. Once kill is closed, commands
+// started with the context, or any context derived from it, are killed
+// outright along with everything they started, including those started with
+// a context whose cancellation was removed with context.WithoutCancel, and no
+// further commands can be started.
+func WithKill(ctx context.Context, kill <-chan struct{}) context.Context {
+	return context.WithValue(ctx, killKey{}, kill)
+}
+
+// Killed returns the channel closed once commands started with ctx are to be
+// killed, or nil if there's none.
+func Killed(ctx context.Context) <-chan struct{} {
+	kill, _ := ctx.Value(killKey{}).(<-chan struct{})
+	return kill
+}
+
+// withKill returns a context that's cancelled with ErrKilled as the cause
+// once commands started with ctx are to be killed.
+func withKill(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if kill := Killed(ctx); kill != nil {
+		go func() {
+			select {
+			case <-kill:
+				cancel(common.ErrKilled)
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, func() { cancel(context.Canceled) }
+}
@@ -0,0 +1,46 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+func TestWithKill(t *testing.T) {
+	if Killed(context.Background()) != nil {
+		t.Fatal("expected no kill channel")
+	}
+
+	kill := make(chan struct{})
+	ctx, cancel := withKill(WithKill(context.Background(), kill))
+	defer cancel()
+	close(kill)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the context to be cancelled")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, common.ErrKilled) {
+		t.Errorf("expected the commands to be killed, got %v", cause)
+	}
+
+	// removing the cancellation leaves the kill channel in place
+	ctx, cancel = withKill(context.WithoutCancel(WithKill(context.Background(), kill)))
+	defer cancel()
+	<-ctx.Done()
+	if cause := context.Cause(ctx); !errors.Is(cause, common.ErrKilled) {
+		t.Errorf("expected the commands to be killed, got %v", cause)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	if grace := gracePeriod(context.Background()); grace != DefaultGrace {
+		t.Errorf("expected the default grace period, got %v", grace)
+	}
+	if grace := gracePeriod(WithGrace(context.Background(), time.Second)); grace != time.Second {
+		t.Errorf("unexpected grace period: %v", grace)
+	}
+}
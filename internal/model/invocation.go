@@ -0,0 +1,92 @@
+package model
+
+import (
+	"fmt"
+	"maps"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/toposort"
+	"go.yaml.in/yaml/v4"
+)
+
+// Invocation represents a task's use of a helper along with the values of
+// any arguments the helper is to be run with.
+//
+// It can be given either as the bare name of the helper, or as a mapping with
+// the name of the helper and its arguments.
+type Invocation struct {
+	Name string            `yaml:"name"`
+	Args map[string]string `yaml:"args,omitempty"`
+}
+
+// UnmarshalYAML allows an invocation to be given as a bare helper name.
+func (i *Invocation) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		i.Name = node.Value
+		return nil
+	}
+	type plain Invocation
+	if err := node.Decode((*plain)(i)); err != nil {
+		return fmt.Errorf("could not parse helper invocation: %w", err)
+	}
+	return nil
+}
+
+// Expand resolves the invocation into invocations of the helper and every
+// helper it transitively requires, each with its arguments resolved. Helpers
+// come after the helpers they require.
+//
+// The values given for the invocation, along with the resolved arguments of
+// the helper, are passed down to the helpers it requires, so a required
+// helper with an argument of the same name gets the same value. Every value
+// given must be for an argument of one of these helpers.
+func (i Invocation) Expand(helpers map[string]*Helper) ([]Invocation, error) {
+	result := []Invocation{}
+	known := map[string]struct{}{}
+	visiting := map[string]bool{}
+
+	var visit func(name string, values map[string]string) error
+	visit = func(name string, values map[string]string) error {
+		h, ok := helpers[name]
+		if !ok {
+			return fmt.Errorf("%q: %w", name, common.ErrUnknownHelper)
+		}
+		if visiting[name] {
+			return fmt.Errorf("helper %q: %w", name, toposort.ErrCycleDetected)
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+
+		args, err := h.Resolve(values)
+		if err != nil {
+			return fmt.Errorf("helper %q: %w", name, err)
+		}
+		for _, arg := range h.Args {
+			known[arg.Name] = struct{}{}
+		}
+
+		down := maps.Clone(values)
+		maps.Copy(down, args)
+		for _, req := range h.Requires {
+			if err := visit(req, down); err != nil {
+				return err
+			}
+		}
+		result = append(result, Invocation{Name: name, Args: args})
+		return nil
+	}
+
+	values := i.Args
+	if values == nil {
+		values = map[string]string{}
+	}
+	if err := visit(i.Name, values); err != nil {
+		return nil, err
+	}
+	for name := range i.Args {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("%q: %w", name, common.ErrUnknownArgument)
+		}
+	}
+	return result, nil
+}
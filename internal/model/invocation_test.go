@@ -0,0 +1,92 @@
+package model
+
+import (
+	"errors"
+	"maps"
+	"testing"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/toposort"
+)
+
+func TestExpand(t *testing.T) {
+	region, none := "us-east-1", ""
+	helpers := map[string]*Helper{
+		"tunnel": {Args: []Argument{{Name: "environment"}, {Name: "region", Default: &region}}},
+		// bastion needs creds, which is passed the same environment
+		"creds":   {Args: []Argument{{Name: "environment"}, {Name: "profile", Default: &none}}},
+		"bastion": {Requires: []string{"creds"}, Args: []Argument{{Name: "environment"}}},
+		"loop-a":  {Requires: []string{"loop-b"}},
+		"loop-b":  {Requires: []string{"loop-a"}},
+	}
+
+	tests := []struct {
+		name       string
+		invocation Invocation
+		expected   []Invocation
+		err        error
+	}{
+		{
+			name:       "arguments",
+			invocation: Invocation{Name: "tunnel", Args: map[string]string{"environment": "prod", "region": "eu-west-1"}},
+			expected:   []Invocation{{Name: "tunnel", Args: map[string]string{"environment": "prod", "region": "eu-west-1"}}},
+		},
+		{
+			name:       "defaults",
+			invocation: Invocation{Name: "tunnel", Args: map[string]string{"environment": "prod"}},
+			expected:   []Invocation{{Name: "tunnel", Args: map[string]string{"environment": "prod", "region": "us-east-1"}}},
+		},
+		{
+			name:       "missing argument",
+			invocation: Invocation{Name: "tunnel"},
+			err:        common.ErrMissingArgument,
+		},
+		{
+			name:       "unknown argument",
+			invocation: Invocation{Name: "tunnel", Args: map[string]string{"environment": "prod", "zone": "a"}},
+			err:        common.ErrUnknownArgument,
+		},
+		{
+			name:       "required helpers",
+			invocation: Invocation{Name: "bastion", Args: map[string]string{"environment": "prod"}},
+			expected: []Invocation{
+				{Name: "creds", Args: map[string]string{"environment": "prod", "profile": ""}},
+				{Name: "bastion", Args: map[string]string{"environment": "prod"}},
+			},
+		},
+		{
+			name:       "values passed down",
+			invocation: Invocation{Name: "bastion", Args: map[string]string{"environment": "prod", "profile": "admin"}},
+			expected: []Invocation{
+				{Name: "creds", Args: map[string]string{"environment": "prod", "profile": "admin"}},
+				{Name: "bastion", Args: map[string]string{"environment": "prod"}},
+			},
+		},
+		{
+			name:       "cycle",
+			invocation: Invocation{Name: "loop-a"},
+			err:        toposort.ErrCycleDetected,
+		},
+		{
+			name:       "unknown helper",
+			invocation: Invocation{Name: "vpn"},
+			err:        common.ErrUnknownHelper,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expanded, err := tt.invocation.Expand(helpers)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if len(expanded) != len(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, expanded)
+			}
+			for i, inv := range expanded {
+				if inv.Name != tt.expected[i].Name || !maps.Equal(inv.Args, tt.expected[i].Args) {
+					t.Fatalf("expected %v, got %v", tt.expected, expanded)
+				}
+			}
+		})
+	}
+}
@@ -1,5 +1,19 @@
 package model
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/logging"
+	"github.com/kgaughan/sagan/internal/tfvars"
+)
+
 // Output represents something to be written to a configuration file upon the
 // completion of a task run. Changes in values may trigger the implicit
 // re-execution of tasks.
@@ -8,3 +22,88 @@ type Output struct {
 	Action string `yaml:"action"`
 	Field  string `yaml:"field,omitempty"`
 }
+
+// Update records a field in a variable file having been changed by an
+// output. The path is absolute.
+type Update struct {
+	Path  string
+	Field string
+	// Fingerprint is that of the field's new value.
+	Fingerprint string
+}
+
+// FetchOutputs runs a command to fetch a task's outputs, which it must write
+// to stdout as a JSON object. The output of `terraform output -json`, where
+// each output is wrapped in an object describing it, is unwrapped.
+func FetchOutputs(ctx context.Context, cmd Command, workdir string, env map[string]string, envMu *sync.Mutex) (map[string]any, error) {
+	out, err := cmd.Capture(ctx, workdir, env, envMu)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch outputs: %w", err)
+	}
+	outputs := map[string]any{}
+	if err := json.Unmarshal([]byte(out), &outputs); err != nil {
+		return nil, fmt.Errorf("could not parse outputs: %w", err)
+	}
+
+	unwrapped := make(map[string]any, len(outputs))
+	for name, output := range outputs {
+		wrapper, ok := output.(map[string]any)
+		if !ok {
+			return outputs, nil
+		}
+		value, ok := wrapper["value"]
+		if !ok {
+			return outputs, nil
+		}
+		unwrapped[name] = value
+	}
+	return unwrapped, nil
+}
+
+// Write applies the output to its target file, relative to the task
+// directory, taking the value of the field of the same name from the task's
+// outputs. If no field is given, every output is written. It returns the
+// fields whose values changed.
+func (o Output) Write(w *tfvars.Writer, workdir string, outputs map[string]any, logCh chan<- logging.TaskLog, taskName string) ([]Update, error) {
+	path := o.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workdir, path)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	action := o.Action
+	if action == "" {
+		action = tfvars.ActionReplace
+	}
+
+	fields := []string{o.Field}
+	if o.Field == "" {
+		fields = slices.Sorted(maps.Keys(outputs))
+	}
+
+	updates := []Update{}
+	for _, field := range fields {
+		value, ok := outputs[field]
+		if !ok {
+			return updates, fmt.Errorf("%q: %w", field, common.ErrNoSuchOutput)
+		}
+		// an added value is only part of the field's value, which is what
+		// triggers watch
+		updated, changed, err := w.Apply(path, action, field, value)
+		if err != nil {
+			return updates, err // nolint:wrapcheck
+		}
+		if changed {
+			fp, err := fingerprint(updated)
+			if err != nil {
+				return updates, fmt.Errorf("could not fingerprint %q: %w", field, err)
+			}
+			updates = append(updates, Update{Path: path, Field: field, Fingerprint: fp})
+			if logCh != nil {
+				logCh <- logging.TaskLog{Task: taskName, Line: fmt.Sprintf("updated %v in %v", field, path)}
+			}
+		}
+	}
+	return updates, nil
+}
@@ -0,0 +1,41 @@
+//go:build !windows
+
+package model
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup has the command run in a process group of its own, so that
+// it and anything it starts can be signalled together.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// interruptGroup interrupts every process in the command's process group.
+func interruptGroup(cmd *exec.Cmd) error {
+	return signalGroup(cmd, syscall.SIGINT)
+}
+
+// terminateGroup asks every process in the command's process group to exit.
+func terminateGroup(cmd *exec.Cmd) error {
+	return signalGroup(cmd, syscall.SIGTERM)
+}
+
+// killGroup kills every process in the command's process group.
+func killGroup(cmd *exec.Cmd) error {
+	return signalGroup(cmd, syscall.SIGKILL)
+}
+
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err // nolint:wrapcheck
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package model
+
+import "os/exec"
+
+// setProcessGroup does nothing, as there are no process groups to put the
+// command in.
+func setProcessGroup(*exec.Cmd) {}
+
+// interruptGroup kills the command's process, as it can't be interrupted.
+func interruptGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill() // nolint:wrapcheck
+}
+
+// terminateGroup kills the command's process, as it can't be asked to exit.
+func terminateGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill() // nolint:wrapcheck
+}
+
+// killGroup kills the command's process.
+func killGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill() // nolint:wrapcheck
+}
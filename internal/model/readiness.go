@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// Readiness represents the conditions a daemon helper must meet before it's
+// considered ready for use. Every condition given must be met. Environment
+// variables in the address, path, and probe are expanded using the helper's
+// arguments and saved values.
+type Readiness struct {
+	// Address is a host:port that must be accepting TCP connections.
+	Address string `yaml:"tcp,omitempty"`
+	// Output is a regular expression that must match a line of the
+	// helper's output.
+	Output string `yaml:"output,omitempty"`
+	// Path is a file that must exist.
+	Path string `yaml:"path,omitempty"`
+	// Probe is a command that must exit successfully.
+	Probe string `yaml:"probe,omitempty"`
+	// Timeout is how long to wait for the helper to become ready.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Interval is how long to wait between checks.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
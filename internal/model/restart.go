@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// Restart policies.
+const (
+	// RestartNever means a daemon helper that dies isn't restarted.
+	RestartNever = "never"
+	// RestartOnFailure means a daemon helper that dies with a failure status
+	// is restarted.
+	RestartOnFailure = "on-failure"
+)
+
+// RestartPolicy represents what's to be done when a daemon helper dies while
+// tasks still need it.
+type RestartPolicy struct {
+	Policy string `yaml:"policy"`
+	// MaxRestarts is how many times the helper may be restarted before
+	// it's given up on.
+	MaxRestarts int `yaml:"max_restarts,omitempty"`
+	// Backoff is how long to wait before the first restart. It doubles with
+	// each subsequent restart.
+	Backoff time.Duration `yaml:"backoff,omitempty"`
+}
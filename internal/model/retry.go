@@ -0,0 +1,146 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.yaml.in/yaml/v4"
+)
+
+const (
+	defaultRetryBackoff = 5 * time.Second
+	maxRetryBackoff     = 5 * time.Minute
+)
+
+// RetryPolicy represents how a failed command or stage is retried.
+type RetryPolicy struct {
+	// Retries is how many times to retry after the first attempt fails.
+	Retries int `yaml:"retries,omitempty"`
+	// RetryOn, if given, limits retries to failures where a line of the
+	// output of the command that failed matches one of these patterns.
+	RetryOn []Pattern `yaml:"retry_on,omitempty"`
+	// Backoff is how long to wait before the first retry. It doubles with
+	// each subsequent retry.
+	Backoff time.Duration `yaml:"backoff,omitempty"`
+}
+
+// Pattern is a regular expression matched against each line of a command's
+// output. It's compiled as the configuration is loaded, so an invalid pattern
+// is reported then.
+type Pattern struct {
+	*regexp.Regexp
+}
+
+// NewPattern compiles a pattern.
+func NewPattern(expr string) (Pattern, error) {
+	if _, err := regexp.Compile(expr); err != nil {
+		return Pattern{}, fmt.Errorf("invalid retry pattern: %w", err)
+	}
+	// each line of the output is matched separately
+	return Pattern{regexp.MustCompile("(?m)" + expr)}, nil
+}
+
+// UnmarshalYAML compiles the pattern.
+func (p *Pattern) UnmarshalYAML(node *yaml.Node) error {
+	var expr string
+	if err := node.Decode(&expr); err != nil {
+		return fmt.Errorf("could not parse retry pattern: %w", err)
+	}
+	pattern, err := NewPattern(expr)
+	if err != nil {
+		return err
+	}
+	*p = pattern
+	return nil
+}
+
+// Attempt describes a failed attempt that's to be retried.
+type Attempt struct {
+	// Command is the position of the command that failed amongst its
+	// stage's commands, counting from 1, or 0 if the whole stage is being
+	// retried.
+	Command int
+	// Number counts the attempts from 1.
+	Number int
+	// Wait is how long until the next attempt.
+	Wait time.Duration
+	Err  error
+}
+
+// CommandError reports a command that failed along with what it wrote to
+// stdout and stderr.
+type CommandError struct {
+	Err    error
+	Output string
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Check verifies the policy's settings are valid. Its patterns are checked
+// as they're loaded.
+func (p RetryPolicy) Check() error {
+	if p.Retries < 0 {
+		return fmt.Errorf("retries can't be negative") // nolint:err113
+	}
+	return nil
+}
+
+// Do calls fn until it succeeds or it's tried as many times as the policy
+// allows, waiting between attempts. The retrying callback, if given, is
+// called before each wait. It gives up early if the failure isn't one the
+// policy retries, ctx is done, or commands started with it are to be killed.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error, retrying func(Attempt)) error {
+	backoff := p.Backoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt > p.Retries || ctx.Err() != nil || !p.retryable(err) {
+			if attempt > 1 {
+				return fmt.Errorf("after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+		if retrying != nil {
+			retrying(Attempt{Number: attempt, Wait: backoff, Err: err})
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("after %d attempts: %w", attempt, err)
+		case <-Killed(ctx):
+			return fmt.Errorf("after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// retryable reports whether the policy retries the failure.
+func (p RetryPolicy) retryable(err error) bool {
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	for _, pattern := range p.RetryOn {
+		if pattern.MatchString(cmdErr.Output) {
+			return true
+		}
+	}
+	return false
+}
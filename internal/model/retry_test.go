@@ -0,0 +1,67 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.yaml.in/yaml/v4"
+)
+
+func TestRetryOnlyMatchingFailures(t *testing.T) {
+	pattern, err := NewPattern("^Error: Throttling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := RetryPolicy{Retries: 3, RetryOn: []Pattern{pattern}, Backoff: time.Millisecond}
+	outputs := []string{"Error: Throttling: Rate exceeded\n", "Planning...\nError: Throttling\n", "Error: invalid\n"}
+
+	attempts := 0
+	retried := []int{}
+	err = policy.Do(context.Background(), func() error {
+		out := outputs[attempts]
+		attempts++
+		return &CommandError{Err: errFailed, Output: out}
+	}, func(a Attempt) {
+		retried = append(retried, a.Number)
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the third failure isn't one to retry
+	if attempts != 3 || len(retried) != 2 {
+		t.Fatalf("expected 3 attempts with 2 retries, got %d with %v", attempts, retried)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	policy := RetryPolicy{Retries: 2, Backoff: time.Millisecond}
+
+	attempts := 0
+	err := policy.Do(context.Background(), func() error {
+		attempts++
+		return errFailed
+	}, nil)
+	if !errors.Is(err, errFailed) || attempts != 3 {
+		t.Fatalf("expected 3 failed attempts, got %d: %v", attempts, err)
+	}
+}
+
+var errFailed = errors.New("failed")
+
+func TestRetryPatternsLoad(t *testing.T) {
+	var cmd Command
+	if err := yaml.Unmarshal([]byte("cmd: make\nretries: 1\nretry_on: ['^Error: Throttling']\n"), &cmd); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmd.Retry.RetryOn) != 1 || !cmd.Retry.retryable(&CommandError{Err: errFailed, Output: "Planning...\nError: Throttling\n"}) {
+		t.Fatalf("expected the pattern to match a line of the output: %+v", cmd.Retry)
+	}
+
+	err := yaml.Unmarshal([]byte("cmd: make\nretries: 1\nretry_on: ['(']\n"), &cmd)
+	if err == nil || !strings.Contains(err.Error(), "invalid retry pattern") {
+		t.Fatalf("expected the invalid pattern to be reported, got %v", err)
+	}
+}
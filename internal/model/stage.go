@@ -1,9 +1,17 @@
 package model
 
+import "time"
+
 // Stage represents a series of commands to be executed followed by some
 // commands to do cleanup afterwards.
 type Stage struct {
 	Requires map[string]string `yaml:"requires,omitempty"`
 	Run      []Command         `yaml:"run,omitempty"`
 	Finalize []Command         `yaml:"finalize,omitempty"`
+	// Timeout limits how long the stage's Run commands may take between
+	// them on each attempt, if positive.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Retry is how the stage's Run commands are retried, from the first, if
+	// one of them fails.
+	Retry RetryPolicy `yaml:",inline"`
 }
@@ -2,13 +2,18 @@ package model
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/kgaughan/sagan/internal/common"
 	"github.com/kgaughan/sagan/internal/logging"
-	"github.com/kgaughan/sagan/internal/toposort"
+	"github.com/kgaughan/sagan/internal/tfvars"
 )
 
 // Task represents something on which a workflow operates.
@@ -16,13 +21,19 @@ import (
 // It can be dependent on another task having run and runs of this task can
 // trigger other tasks to be implicitly re-executed.
 type Task struct {
-	Path       string    `yaml:"path"`
-	Name       string    `yaml:"name"`
-	Workflow   string    `yaml:"workflow"`
-	Requires   []string  `yaml:"requires,omitempty"`
-	Helpers    []string  `yaml:"helpers,omitempty"`
-	Outputs    []Output  `yaml:"outputs,omitempty"`
-	RedeployOn []Trigger `yaml:"redeploy_on,omitempty"`
+	Path       string       `yaml:"path"`
+	Name       string       `yaml:"name"`
+	Workflow   string       `yaml:"workflow"`
+	Requires   []string     `yaml:"requires,omitempty"`
+	Helpers    []Invocation `yaml:"helpers,omitempty"`
+	Outputs    []Output     `yaml:"outputs,omitempty"`
+	RedeployOn []Trigger    `yaml:"redeploy_on,omitempty"`
+	// Timeout limits how long the task may run, if positive.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// StartAt, if set, has Execute skip the stages planned before it, as
+	// when resuming a run that failed at that stage.
+	StartAt string `yaml:"-"`
 }
 
 func (t *Task) Normalize() {
@@ -38,66 +49,217 @@ func (t *Task) Normalize() {
 	}
 }
 
-// Execute runs the workflow for a single task. It runs stage `Run` commands
-// in topological order (based on stage requires) and executes `Finalize`
-// commands in the reverse order. If a command has `SaveAs` set, the stdout is
-// saved into an environment variable with that name for subsequent commands.
-func (t Task) Execute(ctx context.Context, workflows map[string]*Workflow, dryRun bool, env map[string]string, envMu *sync.Mutex, logCh chan<- logging.TaskLog) error {
+// Fingerprints returns the fingerprint of each field watched by the task's
+// `RedeployOn` triggers, keyed by Trigger.Key. Triggers without a path watch
+// the variables loaded from the files in the task's directory matching
+// sources.
+func (t Task) Fingerprints(sources []string) (map[string]string, error) {
+	vars := &tfvars.Vars{}
+	if slices.ContainsFunc(t.RedeployOn, func(tr Trigger) bool { return tr.Path == "" }) {
+		var err error
+		if vars, err = tfvars.Load(t.Path, sources); err != nil {
+			return nil, fmt.Errorf("could not load variables for task %v: %w", t.Path, err)
+		}
+	}
+	fingerprints := make(map[string]string, len(t.RedeployOn))
+	for _, tr := range t.RedeployOn {
+		fp, err := tr.Fingerprint(t.Path, vars)
+		if err != nil {
+			return nil, fmt.Errorf("task %v: %w", t.Path, err)
+		}
+		fingerprints[tr.Key()] = fp
+	}
+	return fingerprints, nil
+}
+
+// Result describes what a run of a task did.
+type Result struct {
+	// Stages holds the stages skipped or started, in that order.
+	Stages []StageResult
+	// Updates holds the fields the task's outputs changed.
+	Updates []Update
+}
+
+// StageResult describes what happened to a stage of a task's workflow.
+type StageResult struct {
+	Name string
+	// Skipped is set if the stage wasn't run because the path it's
+	// required for already exists, or it comes before the stage the task
+	// was to start at.
+	Skipped  bool
+	Started  time.Time
+	Finished time.Time
+	// Err is set if one of the stage's commands failed, including its
+	// finalizers.
+	Err error
+	// Retries holds the failed attempts at running the stage or its
+	// commands that were retried.
+	Retries []Attempt
+}
+
+// Execute runs the workflow for a single task: the `Run` commands of the
+// stages planned by Workflow.Plan, from `StartAt` if it's set, then the
+// task's outputs, and then the `Finalize` commands of every stage started, in
+// reverse. A command's `SaveAs` saves its stdout to the environment.
+func (t Task) Execute(ctx context.Context, workflows map[string]*Workflow, dryRun bool, env map[string]string, envMu *sync.Mutex, logCh chan<- logging.TaskLog, w *tfvars.Writer) (Result, error) {
+	var res Result
+
+	// the finalizers aren't covered by the task's timeout
+	ctx, cancel := WithTimeout(ctx, t.Timeout, "task "+t.Name)
+	defer cancel()
+
+	log := func(line string) {
+		if logCh != nil {
+			logCh <- logging.TaskLog{Task: t.Name, Line: line}
+		}
+	}
+
 	wf, ok := workflows[t.Workflow]
 	if !ok {
-		return fmt.Errorf("%q: %w", t.Workflow, common.ErrUnknownWorkflow)
+		return res, fmt.Errorf("%q: %w", t.Workflow, common.ErrUnknownWorkflow)
 	}
 
-	// build stage graph: dependency -> dependents
-	stageGraph := map[string][]string{}
-	// ensure all stages are present
-	for name := range wf.Stages {
-		stageGraph[name] = []string{}
+	// variables from the task's files are made available to its commands
+	vars, err := tfvars.Load(t.Path, wf.Sources)
+	if err != nil {
+		return res, fmt.Errorf("could not load variables for task %v: %w", t.Path, err)
+	}
+	envMu.Lock()
+	for name, val := range vars.Environment() {
+		// helper values take precedence
+		if _, ok := env[name]; !ok {
+			env[name] = val
+		}
 	}
-	for name, st := range wf.Stages {
-		for _, depStage := range st.Requires {
-			// depStage is the name of a required stage
-			if _, ok := stageGraph[depStage]; !ok {
-				stageGraph[depStage] = []string{}
+	envMu.Unlock()
+
+	// temporaries are created afresh for each run and removed after it
+	if len(wf.Temporaries) > 0 {
+		tmpDir, err := os.MkdirTemp("", "sagan-")
+		if err != nil {
+			return res, fmt.Errorf("could not create temporaries for task %v: %w", t.Path, err)
+		}
+		defer os.RemoveAll(tmpDir)
+		for _, tmp := range wf.Temporaries {
+			path, err := tmp.Create(tmpDir)
+			if err != nil {
+				return res, fmt.Errorf("task %v: %w", t.Path, err)
 			}
-			stageGraph[depStage] = append(stageGraph[depStage], name)
+			envMu.Lock()
+			env[tmp.Name] = path
+			envMu.Unlock()
 		}
 	}
 
-	order, err := toposort.TopologicalSort(stageGraph)
+	envMu.Lock()
+	order, skipped, err := wf.Plan(t.Path, maps.Clone(env))
+	envMu.Unlock()
 	if err != nil {
-		return fmt.Errorf("could not sort stages for task %v: %w", t.Path, err)
+		return res, fmt.Errorf("could not plan stages for task %v: %w", t.Path, err)
+	}
+	for _, stageName := range slices.Sorted(maps.Keys(skipped)) {
+		res.Stages = append(res.Stages, StageResult{Name: stageName, Skipped: true})
+		log(fmt.Sprintf("skipping stage %v as %v exists", stageName, skipped[stageName]))
+	}
+	if i := slices.Index(order, t.StartAt); i > 0 {
+		for _, stageName := range order[:i] {
+			res.Stages = append(res.Stages, StageResult{Name: stageName, Skipped: true})
+			log(fmt.Sprintf("skipping stage %v to start at %v", stageName, t.StartAt))
+		}
+		order = order[i:]
 	}
 
 	finalizers := []struct {
-		stage string
-		cmds  []Command
+		stage  string
+		result int
+		cmds   []Command
 	}{}
 
+	// runCmd runs a command of a stage, retrying it as its policy allows
+	runCmd := func(ctx context.Context, sr *StageResult, i int, cmd Command) error {
+		return cmd.Retry.Do(ctx, func() error {
+			return cmd.Run(ctx, t.Path, dryRun, env, envMu, logCh, t.Name)
+		}, func(a Attempt) {
+			a.Command = i + 1
+			sr.Retries = append(sr.Retries, a)
+			log(fmt.Sprintf("command %d of stage %v failed (attempt %d of %d), retrying in %v: %v", a.Command, sr.Name, a.Number, cmd.Retry.Retries+1, a.Wait, a.Err))
+		})
+	}
+
 	for _, stageName := range order {
 		stage := wf.Stages[stageName]
-		for _, cmd := range stage.Run {
-			if err := cmd.Run(ctx, t.Path, dryRun, env, envMu, logCh, t.Name); err != nil {
-				return fmt.Errorf("task %v stage %v run failed: %w", t.Path, stageName, err)
-			}
-		}
+		res.Stages = append(res.Stages, StageResult{Name: stageName, Started: time.Now()})
+		sr := &res.Stages[len(res.Stages)-1]
+		// a stage that's started is finalized even if it fails
 		if len(stage.Finalize) > 0 {
 			finalizers = append(finalizers, struct {
-				stage string
-				cmds  []Command
-			}{stage: stageName, cmds: stage.Finalize})
+				stage  string
+				result int
+				cmds   []Command
+			}{stage: stageName, result: len(res.Stages) - 1, cmds: stage.Finalize})
 		}
+		// if a command fails for good, the stage may be retried from the
+		// first command
+		err = stage.Retry.Do(ctx, func() error {
+			stageCtx, cancel := WithTimeout(ctx, stage.Timeout, "stage "+stageName)
+			defer cancel()
+			for i, cmd := range stage.Run {
+				if err := runCmd(stageCtx, sr, i, cmd); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, func(a Attempt) {
+			sr.Retries = append(sr.Retries, a)
+			log(fmt.Sprintf("stage %v failed (attempt %d of %d), retrying in %v: %v", stageName, a.Number, stage.Retry.Retries+1, a.Wait, a.Err))
+		})
+		sr.Finished = time.Now()
+		if err != nil {
+			sr.Err = err
+			err = fmt.Errorf("task %v stage %v run failed: %w", t.Path, stageName, err)
+			break
+		}
+	}
+
+	if err == nil && len(t.Outputs) > 0 && !dryRun {
+		var updates []Update
+		updates, err = t.writeOutputs(ctx, *wf.Outputs, env, envMu, logCh, w)
+		res.Updates = append(res.Updates, updates...)
 	}
 
-	// run finalizers in reverse order
+	// Run finalizers in reverse order, even if the task failed or is being
+	// stopped, as they clean up after the stages.
+	errs := []error{err}
+	finalCtx := context.WithoutCancel(ctx)
 	for i := len(finalizers) - 1; i >= 0; i-- {
 		f := finalizers[i]
-		for _, cmd := range f.cmds {
-			if err := cmd.Run(ctx, t.Path, dryRun, env, envMu, logCh, t.Name); err != nil {
-				return fmt.Errorf("task %v stage %v finalize failed: %w", t.Path, f.stage, err)
+		sr := &res.Stages[f.result]
+		for j, cmd := range f.cmds {
+			if err := runCmd(finalCtx, sr, j, cmd); err != nil {
+				sr.Err = errors.Join(sr.Err, err)
+				errs = append(errs, fmt.Errorf("task %v stage %v finalize failed: %w", t.Path, f.stage, err))
+				break
 			}
 		}
 	}
 
-	return nil
+	return res, errors.Join(errs...)
+}
+
+// writeOutputs fetches the task's outputs using cmd and writes them to the
+// files given in its `Outputs`, returning the fields that changed.
+func (t Task) writeOutputs(ctx context.Context, cmd Command, env map[string]string, envMu *sync.Mutex, logCh chan<- logging.TaskLog, w *tfvars.Writer) ([]Update, error) {
+	outputs, err := FetchOutputs(ctx, cmd, t.Path, env, envMu)
+	if err != nil {
+		return nil, fmt.Errorf("task %v: %w", t.Path, err)
+	}
+	var updates []Update
+	for _, o := range t.Outputs {
+		written, err := o.Write(w, t.Path, outputs, logCh, t.Name)
+		updates = append(updates, written...)
+		if err != nil {
+			return updates, fmt.Errorf("task %v could not write outputs: %w", t.Path, err)
+		}
+	}
+	return updates, nil
 }
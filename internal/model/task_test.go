@@ -0,0 +1,102 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecuteFinalizesStartedStages(t *testing.T) {
+	dir := t.TempDir()
+	wf := &Workflow{
+		Sources: []string{},
+		Stages: map[string]Stage{
+			"init": {
+				Run:      []Command{{Command: "echo init >> log"}},
+				Finalize: []Command{{Command: "echo finalize init >> log"}},
+			},
+			"plan": {
+				Requires: map[string]string{"plan.out": "init"},
+				Run:      []Command{{Command: "echo plan >> log; exit 2"}},
+				Finalize: []Command{{Command: "echo finalize plan >> log; exit 3"}},
+			},
+			"apply": {
+				Requires: map[string]string{"plan.out": "plan"},
+				Run:      []Command{{Command: "echo apply >> log"}},
+				Finalize: []Command{{Command: "echo finalize apply >> log"}},
+			},
+		},
+	}
+	task := Task{Path: dir, Name: "test", Workflow: "default"}
+	var envMu sync.Mutex
+
+	res, err := task.Execute(context.Background(), map[string]*Workflow{"default": wf}, false, map[string]string{}, &envMu, nil, nil)
+	if ExitCode(err) != 2 {
+		t.Fatalf("expected the plan stage's failure first, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "finalize failed: exit status 3") {
+		t.Fatalf("expected the finalizer's failure too, got %v", err)
+	}
+	if len(res.Stages) != 2 || res.Stages[0].Err != nil || ExitCode(res.Stages[1].Err) != 2 {
+		t.Fatalf("unexpected stage results: %+v", res.Stages)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "init\nplan\nfinalize plan\nfinalize init\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected commands run:\n%s", data)
+	}
+}
+
+func TestExecuteRemovesTemporaries(t *testing.T) {
+	// the paths are only recorded if they're as expected while running
+	record := `test -d "$scratch" && test ! -e "$plan" && echo "$scratch" > paths`
+	tests := []struct {
+		name      string
+		command   string
+		cancel    bool
+		succeeded bool
+	}{
+		{"succeeded", record, false, true},
+		{"failed", record + "; exit 1", false, false},
+		{"cancelled", record + "; sleep 30", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wf := &Workflow{
+				Sources:     []string{},
+				Temporaries: []Temporary{{Name: "scratch", Type: TemporaryDir}, {Name: "plan", Type: TemporaryFile}},
+				Stages:      map[string]Stage{"apply": {Run: []Command{{Command: tt.command}}}},
+			}
+			task := Task{Path: dir, Name: "test", Workflow: "default"}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(200*time.Millisecond, cancel)
+			}
+			var envMu sync.Mutex
+
+			_, err := task.Execute(ctx, map[string]*Workflow{"default": wf}, false, map[string]string{}, &envMu, nil, nil)
+			if (err == nil) != tt.succeeded {
+				t.Fatalf("unexpected result: %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "paths"))
+			if err != nil {
+				t.Fatalf("expected the temporaries to be passed to the command: %v", err)
+			}
+			scratch := strings.TrimSpace(string(data))
+			if _, err := os.Stat(filepath.Dir(scratch)); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected the temporaries to be removed, got %v", err)
+			}
+		})
+	}
+}
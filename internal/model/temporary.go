@@ -1,7 +1,38 @@
 package model
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+// Temporary types.
+const (
+	// TemporaryFile is a path for a file. The file itself isn't created.
+	TemporaryFile = "file"
+	// TemporaryDir is an empty directory.
+	TemporaryDir = "dir"
+)
+
 // Temporary represents a temporary object of some kind, e.g., a file.
 type Temporary struct {
 	Name string `yaml:"name"`
 	Type string `yaml:"type"`
 }
+
+// Create creates the temporary within dir and returns its path.
+func (t Temporary) Create(dir string) (string, error) {
+	path := filepath.Join(dir, t.Name)
+	switch t.Type {
+	case TemporaryFile:
+	case TemporaryDir:
+		if err := os.Mkdir(path, 0o700); err != nil {
+			return "", fmt.Errorf("could not create temporary %v: %w", t.Name, err)
+		}
+	default:
+		return "", fmt.Errorf("temporary %q has type %q: %w", t.Name, t.Type, common.ErrUnknownTemporary)
+	}
+	return path, nil
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+func TestTemporaryCreate(t *testing.T) {
+	dir := t.TempDir()
+
+	path, err := Temporary{Name: "plan", Type: TemporaryFile}.Create(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "plan") {
+		t.Errorf("unexpected path: %v", path)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the file not to be created, got %v", err)
+	}
+
+	path, err = Temporary{Name: "scratch", Type: TemporaryDir}.Create(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("expected a directory to be created, got %v", err)
+	}
+
+	if _, err := (Temporary{Name: "pipe", Type: "fifo"}).Create(dir); !errors.Is(err, common.ErrUnknownTemporary) {
+		t.Errorf("expected an unknown type, got %v", err)
+	}
+}
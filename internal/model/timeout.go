@@ -0,0 +1,28 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TimeoutError reports that something took longer than it was allowed to.
+type TimeoutError struct {
+	// What names what timed out, such as "stage apply".
+	What  string
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v timed out after %v", e.What, e.Limit)
+}
+
+// WithTimeout returns a context that's cancelled once the limit passes, with
+// a TimeoutError naming what timed out as the cause. If the limit isn't
+// positive, there's no timeout.
+func WithTimeout(ctx context.Context, limit time.Duration, what string) (context.Context, context.CancelFunc) {
+	if limit <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, limit, &TimeoutError{What: what, Limit: limit})
+}
@@ -1,8 +1,93 @@
 package model
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/kgaughan/sagan/internal/tfvars"
+)
+
 // Trigger represents a configuration update that will lead to a task being
-// re-executed.
+// re-executed. A trigger without a path watches one of the task's variables,
+// as loaded from the files matching its workflow's sources.
 type Trigger struct {
 	Path  string `yaml:"path"`
 	Field string `yaml:"field"`
 }
+
+// Key identifies the field the trigger watches.
+func (tr Trigger) Key() string {
+	if tr.Path == "" {
+		return "#" + tr.Field
+	}
+	return filepath.Clean(tr.Path) + "#" + tr.Field
+}
+
+// Matches reports whether an update changed the watched field, with the path
+// being relative to workdir. If the trigger has no path, an update to any of
+// the files in workdir matching the sources will do.
+func (tr Trigger) Matches(workdir string, sources []string, u Update) bool {
+	if tr.Field != u.Field {
+		return false
+	}
+	if tr.Path == "" {
+		if abs, err := filepath.Abs(workdir); err == nil {
+			workdir = abs
+		}
+		return tfvars.Sourced(workdir, sources, u.Path)
+	}
+	path := tr.Path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workdir, path)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path == u.Path
+}
+
+// Fingerprint returns a hash of the current value of the watched field, with
+// the path being relative to workdir. A trigger without a path looks the
+// field up in vars instead. If the file or the field doesn't exist, the
+// fingerprint is empty.
+func (tr Trigger) Fingerprint(workdir string, vars *tfvars.Vars) (string, error) {
+	path := tr.Path
+	contents := vars.Values
+	if path != "" {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workdir, path)
+		}
+		var err error
+		contents, err = tfvars.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		} else if err != nil {
+			return "", err // nolint:wrapcheck
+		}
+	}
+	val, ok := contents[tr.Field]
+	if !ok {
+		return "", nil
+	}
+	fp, err := fingerprint(val)
+	if err != nil {
+		return "", fmt.Errorf("could not fingerprint %q in %v: %w", tr.Field, path, err)
+	}
+	return fp, nil
+}
+
+// fingerprint hashes a value decoded from JSON.
+func fingerprint(val any) (string, error) {
+	// object fields are marshalled in sorted order, so this is canonical
+	data, err := json.Marshal(val)
+	if err != nil {
+		return "", err // nolint:wrapcheck
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,67 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTriggerWatchingVariables(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sources := []string{"*.auto.tfvars.json", "terraform.tfvars.json"}
+	task := Task{Path: dir, RedeployOn: []Trigger{{Field: "zone"}, {Path: "other.json", Field: "zone"}}}
+
+	write("terraform.tfvars.json", `{"zone": "a"}`)
+	write("other.json", `{"zone": "a"}`)
+	before, err := task.Fingerprints(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before["#zone"] == "" || before["#zone"] != before["other.json#zone"] {
+		t.Fatalf("unexpected fingerprints: %v", before)
+	}
+
+	// the file matching the last pattern takes precedence
+	write("b.auto.tfvars.json", `{"zone": "b"}`)
+	after, err := task.Fingerprints(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["#zone"] != before["#zone"] {
+		t.Errorf("expected the variable not to change: %v -> %v", before, after)
+	}
+	write("terraform.tfvars.json", `{"region": "x"}`)
+	after, err = task.Fingerprints(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["#zone"] == before["#zone"] || after["other.json#zone"] != before["other.json#zone"] {
+		t.Errorf("expected only the variable to change: %v -> %v", before, after)
+	}
+
+	write("b.auto.tfvars.json", "{")
+	if _, err := task.Fingerprints(sources); err == nil {
+		t.Error("expected a malformed variable file to be reported")
+	}
+
+	tr := task.RedeployOn[0]
+	for path, expected := range map[string]bool{
+		"b.auto.tfvars.json":    true,
+		"terraform.tfvars.json": true,
+		"other.json":            false,
+	} {
+		u := Update{Path: filepath.Join(dir, path), Field: "zone"}
+		if tr.Matches(dir, sources, u) != expected {
+			t.Errorf("expected an update to %v to match: %v", path, expected)
+		}
+	}
+	if tr.Matches(dir, sources, Update{Path: filepath.Join(dir, "terraform.tfvars.json"), Field: "region"}) {
+		t.Error("expected an update to another field not to match")
+	}
+}
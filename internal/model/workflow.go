@@ -1,11 +1,153 @@
 package model
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/tfvars"
+	"github.com/kgaughan/sagan/internal/toposort"
+)
+
 // Workflow represents a series of build stages with dependencies between them.
 //
 // Stages must specify their order via dependencies and will be sorted using a
 // topological sort to figure out their execution and finalization order.
 type Workflow struct {
-	Temporaries []Temporary      `yaml:"temporaries,omitempty"`
-	Sources     []string         `yaml:"load,omitempty"`
-	Stages      map[string]Stage `yaml:",inline"`
+	Temporaries []Temporary `yaml:"temporaries,omitempty"`
+	Sources     []string    `yaml:"load,omitempty"`
+	// Outputs is the command used to fetch a task's outputs as a JSON
+	// object.
+	Outputs *Command         `yaml:"outputs,omitempty"`
+	Stages  map[string]Stage `yaml:",inline"`
+}
+
+// DefaultOutputs is the command used to fetch a task's outputs when a
+// workflow doesn't specify one.
+const DefaultOutputs = "terraform output -json"
+
+// Normalize fills in defaults.
+func (wf *Workflow) Normalize() {
+	if wf.Sources == nil {
+		wf.Sources = tfvars.DefaultSources
+	}
+	if wf.Outputs == nil {
+		wf.Outputs = &Command{Command: DefaultOutputs}
+	}
+}
+
+// Check verifies that every stage the workflow's stages require exists, that
+// they don't require one another in a cycle, and that their retry policies
+// are valid.
+func (wf Workflow) Check() error {
+	// build stage graph: dependency -> dependents
+	stageGraph := map[string][]string{}
+	// ensure all stages are present
+	for name := range wf.Stages {
+		stageGraph[name] = []string{}
+	}
+	for name, st := range wf.Stages {
+		for _, depStage := range st.Requires {
+			// depStage is the name of a required stage
+			if _, ok := wf.Stages[depStage]; !ok {
+				return fmt.Errorf("stage %q requires %q: %w", name, depStage, common.ErrUnknownStage)
+			}
+			stageGraph[depStage] = append(stageGraph[depStage], name)
+		}
+		if err := st.Retry.Check(); err != nil {
+			return fmt.Errorf("stage %q: %w", name, err)
+		}
+		for _, cmd := range slices.Concat(st.Run, st.Finalize) {
+			if err := cmd.Retry.Check(); err != nil {
+				return fmt.Errorf("stage %q: %w", name, err)
+			}
+		}
+	}
+
+	if _, err := toposort.TopologicalSort(stageGraph); err != nil {
+		return fmt.Errorf("could not sort stages: %w", err)
+	}
+	return nil
+}
+
+// Plan works out which stages to run, and in what order, for a task in the
+// directory dir.
+//
+// Much like make, stages that no other stage requires are always run, but a
+// required stage is only run if the path it's required for doesn't exist.
+// Paths are relative to dir and may refer to environment variables, which are
+// expanded using env, so temporaries can be required too. Stages that don't
+// need to be run are returned along with the path that already exists.
+func (wf Workflow) Plan(dir string, env map[string]string) ([]string, map[string]string, error) {
+	if err := wf.Check(); err != nil {
+		return nil, nil, err
+	}
+
+	required := map[string]bool{}
+	for _, st := range wf.Stages {
+		for _, depStage := range st.Requires {
+			required[depStage] = true
+		}
+	}
+	goals := []string{}
+	for name := range wf.Stages {
+		if !required[name] {
+			goals = append(goals, name)
+		}
+	}
+	slices.Sort(goals)
+
+	order := []string{}
+	planned := map[string]bool{}
+	skipped := map[string]string{}
+	var visit func(name string)
+	visit = func(name string) {
+		if planned[name] {
+			return
+		}
+		planned[name] = true
+		st := wf.Stages[name]
+		paths := make([]string, 0, len(st.Requires))
+		for path := range st.Requires {
+			paths = append(paths, path)
+		}
+		slices.Sort(paths)
+		for _, path := range paths {
+			depStage := st.Requires[path]
+			if path != "" {
+				path = expandPath(dir, path, env)
+				if _, err := os.Stat(path); err == nil {
+					if !planned[depStage] {
+						skipped[depStage] = path
+					}
+					continue
+				}
+			}
+			delete(skipped, depStage)
+			visit(depStage)
+		}
+		order = append(order, name)
+	}
+	for _, name := range goals {
+		visit(name)
+	}
+
+	return order, skipped, nil
+}
+
+// expandPath expands environment variables in path, preferring those in env,
+// and makes it relative to dir if it isn't absolute.
+func expandPath(dir, path string, env map[string]string) string {
+	path = os.Expand(path, func(name string) string {
+		if val, ok := env[name]; ok {
+			return val
+		}
+		return os.Getenv(name)
+	})
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
 }
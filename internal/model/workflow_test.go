@@ -0,0 +1,84 @@
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/kgaughan/sagan/internal/toposort"
+)
+
+func terraformWorkflow() Workflow {
+	return Workflow{
+		Stages: map[string]Stage{
+			"init":  {},
+			"plan":  {Requires: map[string]string{".terraform": "init"}},
+			"apply": {Requires: map[string]string{"$plan": "plan"}},
+		},
+	}
+}
+
+func TestPlanRunsEverythingWhenNothingExists(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{"plan": filepath.Join(dir, "plan.out")}
+
+	order, skipped, err := terraformWorkflow().Plan(dir, env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"init", "plan", "apply"}; !slices.Equal(order, expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("expected nothing to be skipped, got %v", skipped)
+	}
+}
+
+func TestPlanSkipsStagesWhosePathsExist(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, ".terraform"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"plan": filepath.Join(dir, "plan.out")}
+
+	order, skipped, err := terraformWorkflow().Plan(dir, env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"plan", "apply"}; !slices.Equal(order, expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+	if path := skipped["init"]; path != filepath.Join(dir, ".terraform") {
+		t.Errorf("expected init to be skipped for .terraform, got %q", path)
+	}
+}
+
+func TestPlanExpandsVariablesInPaths(t *testing.T) {
+	dir := t.TempDir()
+	plan := filepath.Join(dir, "plan.out")
+	if err := os.WriteFile(plan, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	order, _, err := terraformWorkflow().Plan(dir, map[string]string{"plan": plan})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"apply"}; !slices.Equal(order, expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+}
+
+func TestPlanRejectsCycles(t *testing.T) {
+	wf := Workflow{
+		Stages: map[string]Stage{
+			"a": {Requires: map[string]string{"x": "b"}},
+			"b": {Requires: map[string]string{"y": "a"}},
+		},
+	}
+	if _, _, err := wf.Plan(t.TempDir(), nil); !errors.Is(err, toposort.ErrCycleDetected) {
+		t.Errorf("expected ErrCycleDetected, got %v", err)
+	}
+}
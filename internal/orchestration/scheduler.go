@@ -4,181 +4,433 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
+
+	"github.com/kgaughan/sagan/internal/common"
+	"github.com/kgaughan/sagan/internal/toposort"
 )
 
 var ErrPossibleCycleDetected = errors.New("possible cycle detected")
 
+// nodeState tracks where a node is in its current run.
+type nodeState int
+
+const (
+	// waiting nodes have unmet dependencies.
+	waiting nodeState = iota
+	// ready nodes are waiting to be admitted or picked up by a worker.
+	ready
+	running
+	done
+	failed
+	// blocked nodes can't run because something they depend on failed.
+	blocked
+)
+
 // Scheduler enqueues and runs tasks when their declared dependencies are
 // satisfied. It doesn't know how to execute a task's workflow: an executor
 // callback is provided by the caller.
+//
+// Nodes and edges can be added with Schedule while the scheduler is running,
+// including to have a node that's already run be run again.
 type Scheduler struct {
+	mu sync.Mutex
 	// dependents maps a node to the list of nodes that depend on it.
 	dependents map[string][]string
+	// requires maps a node to the list of nodes it depends on.
+	requires map[string][]string
 	// inDegree tracks number of unmet dependencies per node.
 	inDegree map[string]int
-	// total nodes
-	total int
+	state    map[string]nodeState
+	// rerun holds the running nodes that need to be run again once they're
+	// done.
+	rerun map[string]bool
+	// queue holds the ready nodes that have yet to be offered to workers.
+	queue []string
+	// deferred holds the ready nodes that weren't admitted.
+	deferred []string
+
+	// Admit, if set, is consulted before a ready task is dispatched. A task
+	// that isn't admitted is held back and offered again whenever another
+	// task completes. If force is set, nothing else is running, so Admit
+	// must do whatever it needs to in order to admit the task.
+	Admit func(name string, force bool) bool
+
+	// KeepGoing has the scheduler carry on running tasks that don't depend
+	// on a task that failed, rather than stopping at the first failure.
+	KeepGoing bool
+	// Blocked, if set, is called for each task that won't be run because a
+	// task it depends on failed.
+	Blocked func(name, failed string)
 }
 
 // NewScheduler builds a Scheduler from a dependency graph as produced by
 // BuildDependencyGraph (dependency -> dependents).
 func NewScheduler(graph map[string][]string) *Scheduler {
-	inDeg := map[string]int{}
-	dependents := map[string][]string{}
+	s := &Scheduler{
+		dependents: map[string][]string{},
+		requires:   map[string][]string{},
+		inDegree:   map[string]int{},
+		state:      map[string]nodeState{},
+		rerun:      map[string]bool{},
+	}
 
 	// ensure every node is present
 	for n := range graph {
-		inDeg[n] = 0
-		dependents[n] = []string{}
+		s.add(n)
 	}
 
 	// graph maps dependency -> dependents; compute inDegree counts
 	for dep, adj := range graph {
 		for _, v := range adj {
-			inDeg[v]++
-			// ensure the dependent exists in dependents map
-			if _, ok := dependents[dep]; !ok {
-				dependents[dep] = []string{}
-			}
-			dependents[dep] = append(dependents[dep], v)
+			s.add(v)
+			s.dependents[dep] = append(s.dependents[dep], v)
+			s.requires[v] = append(s.requires[v], dep)
+			s.inDegree[v]++
+		}
+	}
+
+	return s
+}
+
+// add adds a node that's yet to run if it isn't already known.
+func (s *Scheduler) add(n string) bool {
+	if _, ok := s.state[n]; ok {
+		return false
+	}
+	s.dependents[n] = []string{}
+	s.requires[n] = []string{}
+	s.inDegree[n] = 0
+	s.state[n] = waiting
+	return true
+}
+
+// reaches reports whether there's a path from one node to another.
+func (s *Scheduler) reaches(from, to string) bool {
+	seen := map[string]bool{}
+	stack := []string{from}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if n == to {
+			return true
+		}
+		if seen[n] {
+			continue
 		}
+		seen[n] = true
+		stack = append(stack, s.dependents[n]...)
 	}
+	return false
+}
 
-	return &Scheduler{
-		dependents: dependents,
-		inDegree:   inDeg,
-		total:      len(inDeg),
+// requeue has a node that's run be run again, once the nodes it depends on
+// that haven't yet run have done so. If any of them failed or is blocked,
+// the node is blocked too, and that node is returned. The caller must hold
+// s.mu.
+func (s *Scheduler) requeue(n string) string {
+	s.inDegree[n] = 0
+	for _, dep := range s.requires[n] {
+		switch s.state[dep] {
+		case done:
+		case failed, blocked:
+			s.state[n] = blocked
+			return dep
+		default:
+			s.inDegree[n]++
+		}
+	}
+	s.state[n] = waiting
+	if s.inDegree[n] == 0 {
+		s.state[n] = ready
+		s.queue = append(s.queue, n)
 	}
+	return ""
 }
 
-// Run executes the scheduled tasks using up to workerCount concurrent
-// workers. The exec callback is invoked for each task. If exec returns an
-// error the scheduler cancels remaining work and returns that error. The
-// returned slice contains task names in the order they were completed.
+// block marks everything yet to run that depends on a failed node, directly
+// or indirectly, as blocked, returning the nodes blocked. The caller must
+// hold s.mu.
+func (s *Scheduler) block(n string) []string {
+	nodes := []string{}
+	stack := slices.Clone(s.dependents[n])
+	for len(stack) > 0 {
+		dep := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if st := s.state[dep]; st != waiting && st != ready {
+			continue
+		}
+		s.state[dep] = blocked
+		nodes = append(nodes, dep)
+		stack = append(stack, s.dependents[dep]...)
+	}
+	s.unqueue()
+	return nodes
+}
+
+// hold has the dependents of a node that's to be run again that have yet to
+// start wait for it again. The caller must hold s.mu.
+func (s *Scheduler) hold(n string) {
+	for _, dep := range s.dependents[n] {
+		switch s.state[dep] {
+		case waiting:
+			s.inDegree[dep]++
+		case ready:
+			// it's no longer to be offered until the node has run again
+			s.inDegree[dep] = 1
+			s.state[dep] = waiting
+		}
+	}
+	s.unqueue()
+}
+
+// unqueue drops the nodes that are no longer ready from those to be offered.
+// The caller must hold s.mu.
+func (s *Scheduler) unqueue() {
+	stale := func(n string) bool { return s.state[n] != ready }
+	s.queue = slices.DeleteFunc(s.queue, stale)
+	s.deferred = slices.DeleteFunc(s.deferred, stale)
+}
+
+// Schedule has a node run once each of the given nodes has run, adding the
+// node if it's not already known. If the node has already run, it's run
+// again, and anything depending on it that has yet to start waits for it
+// again; if it's running, it's run again once it's done. If the node has yet
+// to run, it will now also wait for the given nodes. Edges that would
+// introduce a cycle are rejected. It reports whether this results in a new
+// run of the node.
+//
+// It can be called before the scheduler is run or, while it's running, from
+// the executor callback.
+func (s *Scheduler) Schedule(name string, after ...string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range after {
+		if _, ok := s.state[a]; !ok {
+			return false, fmt.Errorf("%q: %w", a, common.ErrUnknownTask)
+		}
+		if a == name || s.reaches(name, a) {
+			return false, fmt.Errorf("scheduling %q after %q: %w", name, a, toposort.ErrCycleDetected)
+		}
+	}
+
+	added := s.add(name)
+	unmet := 0
+	for _, a := range after {
+		if slices.Contains(s.dependents[a], name) {
+			continue
+		}
+		s.dependents[a] = append(s.dependents[a], name)
+		s.requires[name] = append(s.requires[name], a)
+		if s.state[a] != done {
+			unmet++
+		}
+	}
+
+	switch s.state[name] {
+	case waiting:
+		s.inDegree[name] += unmet
+		if added && s.inDegree[name] == 0 {
+			s.state[name] = ready
+			s.queue = append(s.queue, name)
+		}
+	case ready:
+		if unmet > 0 {
+			// it has to wait again, so it's no longer to be offered
+			s.inDegree[name] += unmet
+			s.state[name] = waiting
+			s.unqueue()
+		}
+	case running:
+		if s.rerun[name] {
+			return false, nil
+		}
+		s.rerun[name] = true
+		return true, nil
+	case done:
+		if s.requeue(name) != "" {
+			return false, nil
+		}
+		// anything yet to run that depends on it has to wait for it again
+		s.hold(name)
+		return true, nil
+	}
+	return added, nil
+}
+
+// result is the outcome of a task's run.
+type result struct {
+	name string
+	err  error
+}
+
+// Run executes the scheduled tasks using up to nWorkers concurrent workers.
+// The exec callback is invoked for each task in a goroutine of its own,
+// while a single loop keeps track of which tasks are ready and dispatches
+// them, so dispatching a task never waits on another finishing.
+//
+// If exec returns an error, no further tasks are dispatched and Run returns
+// the error once the tasks already running are done; the same goes if ctx
+// is cancelled. With KeepGoing set, only the tasks depending on the failed
+// one are blocked, and Run returns every failure joined together once
+// everything else has run.
+//
+// The returned slice contains task names in the order they were completed;
+// a task that was run more than once appears once for each run.
 func (s *Scheduler) Run(ctx context.Context, nWorkers int, exec func(string) error) ([]string, error) {
 	if nWorkers <= 0 {
 		nWorkers = 1
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	taskCh := make(chan string)
-	doneCh := make(chan string)
-	errCh := make(chan error, 1)
-
-	var wg sync.WaitGroup
+	// every task sends its result without waiting on the loop
+	results := make(chan result, nWorkers)
+	completed := []string{}
+	// active counts the tasks running
+	active := 0
+	errs := []error{}
+	// stopped is set once no more tasks are to be dispatched
+	stopped := false
 
-	// worker pool
-	for range nWorkers {
-		wg.Add(1)
+	// dispatch starts a task. The caller must hold s.mu.
+	dispatch := func(t string) {
+		s.state[t] = running
+		active++
 		go func() {
-			defer wg.Done()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case t, ok := <-taskCh:
-					if !ok {
-						return
-					}
-					if err := exec(t); err != nil {
-						select {
-						case errCh <- err:
-						default:
-						}
-						cancel()
-						return
-					}
-					select {
-					case doneCh <- t:
-					case <-ctx.Done():
-						return
-					}
-				}
-			}
+			results <- result{name: t, err: exec(t)}
 		}()
 	}
 
-	var mutex sync.Mutex
-	completed := []string{}
+	// notify reports the tasks blocked by a failure. The caller must hold
+	// s.mu, which is released while doing so.
+	notify := func(nodes []string, failed string) {
+		if s.Blocked == nil || len(nodes) == 0 {
+			return
+		}
+		s.mu.Unlock()
+		defer s.mu.Lock()
+		for _, n := range nodes {
+			s.Blocked(n, failed)
+		}
+	}
 
-	// find tasks that can be immediately enqueued
-	ready := make([]string, 0)
+	s.mu.Lock()
 	for n, deg := range s.inDegree {
-		if deg == 0 {
-			ready = append(ready, n)
-		}
-	}
-
-	// feed tasks into the workers
-	go func() {
-		defer close(taskCh)
-		// enqueue initial ready list
-		mutex.Lock()
-		for _, t := range ready {
-			select {
-			case taskCh <- t:
-			case <-ctx.Done():
-				mutex.Unlock()
-				return
-			}
+		if deg == 0 && s.state[n] == waiting {
+			s.state[n] = ready
+			s.queue = append(s.queue, n)
 		}
-		// clear ready so it's not enqueued again
-		ready = nil
-		mutex.Unlock()
-
-		// now wait for completions and enqueue newly-ready tasks
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case d, ok := <-doneCh:
-				if !ok {
-					return
+	}
+	// the initial order is that of map iteration, so make it predictable
+	slices.Sort(s.queue)
+
+	for {
+		if !stopped {
+			// held back tasks get first refusal
+			offered := slices.Concat(s.deferred, s.queue)
+			s.deferred = nil
+			s.queue = nil
+			for i, t := range offered {
+				if active >= nWorkers {
+					// keep the rest in order for next time
+					s.queue = append(s.queue, offered[i:]...)
+					break
 				}
-				mutex.Lock()
-				// mark completed
-				completed = append(completed, d)
-				// decrement dependents
-				for _, dep := range s.dependents[d] {
-					s.inDegree[dep]--
-					if s.inDegree[dep] == 0 {
-						select {
-						case taskCh <- dep:
-						case <-ctx.Done():
-							mutex.Unlock()
-							return
-						}
-					}
+				// Schedule may have made it wait again, or it may
+				// have been blocked
+				if s.state[t] != ready {
+					continue
 				}
-				mutex.Unlock()
-
-				// if we've completed all nodes, we're done
-				if len(completed) >= s.total {
-					return
+				if s.Admit != nil && !s.Admit(t, false) {
+					s.deferred = append(s.deferred, t)
+					continue
+				}
+				dispatch(t)
+			}
+			// if nothing's running, nothing will finish to let a held
+			// back task through, so force the first one
+			if active == 0 && len(s.deferred) > 0 {
+				t := s.deferred[0]
+				s.deferred = s.deferred[1:]
+				if s.Admit(t, true) {
+					dispatch(t)
+				} else {
+					s.deferred = append(s.deferred, t)
 				}
 			}
 		}
-	}()
+		if active == 0 {
+			break
+		}
+		s.mu.Unlock()
 
-	// wait for workers to finish (they will exit when taskCh is closed)
-	wg.Wait()
+		var r result
+		select {
+		case r = <-results:
+		case <-ctx.Done():
+			s.mu.Lock()
+			if !stopped {
+				stopped = true
+				errs = append(errs, context.Cause(ctx))
+			}
+			s.mu.Unlock()
+			// stop dispatching, but let the running tasks finish
+			r = <-results
+		}
+
+		s.mu.Lock()
+		active--
+		if r.err != nil {
+			errs = append(errs, r.err)
+			s.state[r.name] = failed
+			delete(s.rerun, r.name)
+			if !s.KeepGoing {
+				stopped = true
+				continue
+			}
+			notify(s.block(r.name), r.name)
+			continue
+		}
+		completed = append(completed, r.name)
+		if s.rerun[r.name] {
+			// anything depending on it is still waiting for it
+			delete(s.rerun, r.name)
+			if cause := s.requeue(r.name); cause != "" {
+				// so is anything waiting for it
+				notify(append([]string{r.name}, s.block(r.name)...), cause)
+			}
+			continue
+		}
+		s.state[r.name] = done
+		for _, dep := range s.dependents[r.name] {
+			if s.state[dep] != waiting {
+				continue
+			}
+			s.inDegree[dep]--
+			if s.inDegree[dep] == 0 {
+				s.state[dep] = ready
+				s.queue = append(s.queue, dep)
+			}
+		}
+	}
+	unfinished := 0
+	for _, st := range s.state {
+		if st == waiting || st == ready {
+			unfinished++
+		}
+	}
+	s.mu.Unlock()
 
-	// check for error
-	select {
-	case err := <-errCh:
-		return completed, err
-	default:
+	if len(errs) > 0 {
+		return completed, errors.Join(errs...)
 	}
 
-	// if not all tasks completed, there may be a cycle. If this ever happens,
+	// if any tasks didn't run, there may be a cycle. If this ever happens,
 	// we've a bug as the topological sort we do at the beginning ought to
-	// find these, but that should only be the case if everything that's run
-	// has succeeded.
-	if len(completed) < s.total {
-		return completed, fmt.Errorf("not all tasks completed (%d/%d): %w", len(completed), s.total, ErrPossibleCycleDetected)
+	// find these, and Schedule refuses to add any.
+	if unfinished > 0 {
+		return completed, fmt.Errorf("%d tasks never became ready: %w", unfinished, ErrPossibleCycleDetected)
 	}
 
 	return completed, nil
@@ -0,0 +1,449 @@
+package orchestration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/toposort"
+)
+
+func TestScheduleRerunsCompletedTask(t *testing.T) {
+	s := NewScheduler(map[string][]string{"a": {}, "b": {}})
+
+	runs := []string{}
+	completed, err := s.Run(context.Background(), 1, func(name string) error {
+		runs = append(runs, name)
+		if len(runs) == 2 {
+			added, err := s.Schedule(runs[0], name)
+			if err != nil {
+				t.Error(err)
+			}
+			if !added {
+				t.Error("expected the completed task to be run again")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 3 || completed[2] != completed[0] {
+		t.Fatalf("unexpected runs: %v", completed)
+	}
+}
+
+func TestRerunAfterFailureBlocksDependents(t *testing.T) {
+	s := NewScheduler(map[string][]string{"a": {}, "b": {"c"}, "c": {}})
+	s.KeepGoing = true
+	var mu sync.Mutex
+	aFailed := false
+	// hold b back until a has failed
+	s.Admit = func(name string, force bool) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return name != "b" || aFailed || force
+	}
+	blocked := map[string]string{}
+	s.Blocked = func(name, failed string) {
+		mu.Lock()
+		defer mu.Unlock()
+		blocked[name] = failed
+	}
+
+	completed, err := s.Run(context.Background(), 1, func(name string) error {
+		switch name {
+		case "a":
+			mu.Lock()
+			aFailed = true
+			mu.Unlock()
+			return errFailed
+		case "b":
+			if _, err := s.Schedule("b", "a"); err != nil {
+				t.Error(err)
+			}
+		}
+		return nil
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("expected the failure to be reported, got %v", err)
+	}
+	if slices.Contains(completed, "c") {
+		t.Fatalf("expected c not to run, got %v", completed)
+	}
+	if blocked["b"] != "a" || blocked["c"] != "a" {
+		t.Fatalf("expected b and c to be blocked by a, got %v", blocked)
+	}
+}
+
+func TestRerunHoldsBackReadyDependents(t *testing.T) {
+	// c is ready once b has run, but b is run again after x
+	s := NewScheduler(map[string][]string{"b": {"c"}, "c": {}, "x": {}})
+
+	completed, err := s.Run(context.Background(), 1, func(name string) error {
+		if name == "x" {
+			if _, err := s.Schedule("b", "x"); err != nil {
+				t.Error(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"b", "x", "b", "c"}; !slices.Equal(completed, expected) {
+		t.Fatalf("expected %v, got %v", expected, completed)
+	}
+}
+
+func TestScheduleRejectsCycles(t *testing.T) {
+	s := NewScheduler(map[string][]string{"a": {"b"}, "b": {}})
+
+	completed, err := s.Run(context.Background(), 1, func(name string) error {
+		if name != "b" {
+			return nil
+		}
+		for _, n := range []string{"a", "b"} {
+			if _, err := s.Schedule(n, "b"); !errors.Is(err, toposort.ErrCycleDetected) {
+				t.Errorf("expected scheduling %v after b to be rejected, got %v", n, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(completed, []string{"a", "b"}) {
+		t.Fatalf("unexpected runs: %v", completed)
+	}
+}
+
+// randomGraph builds a random DAG of n nodes as a map of dependencies to
+// dependents. Edges only go from lower to higher numbered nodes, so there
+// can't be a cycle.
+func randomGraph(rng *rand.Rand, n int, density float64) map[string][]string {
+	graph := map[string][]string{}
+	for i := range n {
+		graph[node(i)] = []string{}
+	}
+	for i := range n {
+		for j := i + 1; j < n; j++ {
+			if rng.Float64() < density {
+				graph[node(i)] = append(graph[node(i)], node(j))
+			}
+		}
+	}
+	return graph
+}
+
+func node(i int) string {
+	return fmt.Sprintf("n%03d", i)
+}
+
+// runChecked runs a scheduler for the graph, checking that every task runs
+// exactly once, only after everything it depends on, and that no more than
+// nWorkers run at once. If admit is set, it's used to hold back tasks.
+func runChecked(t *testing.T, graph map[string][]string, nWorkers int, admit func(running map[string]bool, name string) bool) {
+	t.Helper()
+
+	s := NewScheduler(graph)
+	var mu sync.Mutex
+	running := map[string]bool{}
+	finished := map[string]bool{}
+	if admit != nil {
+		s.Admit = func(name string, force bool) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return force || admit(running, name)
+		}
+	}
+
+	requires := map[string][]string{}
+	for dep, adj := range graph {
+		for _, v := range adj {
+			requires[v] = append(requires[v], dep)
+		}
+	}
+
+	done := make(chan struct{})
+	var completed []string
+	var err error
+	go func() {
+		defer close(done)
+		completed, err = s.Run(context.Background(), nWorkers, func(name string) error {
+			mu.Lock()
+			if running[name] || finished[name] {
+				t.Errorf("%v run twice", name)
+			}
+			for _, dep := range requires[name] {
+				if !finished[dep] {
+					t.Errorf("%v started before %v finished", name, dep)
+				}
+			}
+			running[name] = true
+			if len(running) > nWorkers {
+				t.Errorf("%v tasks running with %v workers", len(running), nWorkers)
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Duration(len(name)%3) * 100 * time.Microsecond)
+
+			mu.Lock()
+			delete(running, name)
+			finished[name] = true
+			mu.Unlock()
+			return nil
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("scheduler hung with %v workers", nWorkers)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != len(graph) {
+		t.Fatalf("expected %v tasks to complete, got %v", len(graph), len(completed))
+	}
+}
+
+func TestRunRandomGraphs(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2)) // #nosec G404
+	for i := range 200 {
+		n := 1 + rng.IntN(40)
+		graph := randomGraph(rng, n, rng.Float64()*0.3)
+		nWorkers := 1 + rng.IntN(8)
+		t.Run(fmt.Sprintf("%v/%v-nodes/%v-workers", i, n, nWorkers), func(t *testing.T) {
+			runChecked(t, graph, nWorkers, nil)
+		})
+	}
+}
+
+func TestRunRandomGraphsWithAdmission(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4)) // #nosec G404
+	for i := range 100 {
+		n := 1 + rng.IntN(30)
+		graph := randomGraph(rng, n, rng.Float64()*0.2)
+		nWorkers := 1 + rng.IntN(6)
+		// tasks in the same group can't run at the same time
+		groups := 1 + rng.IntN(4)
+		t.Run(fmt.Sprintf("%v/%v-nodes/%v-workers/%v-groups", i, n, nWorkers, groups), func(t *testing.T) {
+			group := func(name string) byte { return name[len(name)-1] % byte(groups) }
+			runChecked(t, graph, nWorkers, func(running map[string]bool, name string) bool {
+				for other := range running {
+					if group(other) == group(name) {
+						return false
+					}
+				}
+				return true
+			})
+		})
+	}
+}
+
+// TestRunFanOut covers a single worker with a task that has many dependents
+// becoming ready at once, which used to hang.
+func TestRunFanOut(t *testing.T) {
+	graph := map[string][]string{"root": {}}
+	for i := range 20 {
+		graph["root"] = append(graph["root"], node(i))
+		graph[node(i)] = []string{"leaf"}
+	}
+	graph["leaf"] = []string{}
+	for _, nWorkers := range []int{1, 2, 3} {
+		runChecked(t, graph, nWorkers, nil)
+	}
+}
+
+func TestRunStopsOnError(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6)) // #nosec G404
+	for i := range 50 {
+		n := 2 + rng.IntN(30)
+		graph := randomGraph(rng, n, 0.1)
+		failing := node(rng.IntN(n))
+		nWorkers := 1 + rng.IntN(4)
+		s := NewScheduler(graph)
+
+		var mu sync.Mutex
+		failed := false
+		// only tasks dispatched alongside the failing one may start after
+		// it fails
+		late := 0
+		completed, err := s.Run(context.Background(), nWorkers, func(name string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if failed {
+				late++
+			}
+			if name == failing {
+				failed = true
+				return errFailed
+			}
+			return nil
+		})
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("run %v: expected the failure to be reported, got %v", i, err)
+		}
+		if slices.Contains(completed, failing) {
+			t.Fatalf("run %v: %v reported as completed", i, failing)
+		}
+		if late > nWorkers-1 {
+			t.Fatalf("run %v: %v tasks started after %v failed with %v workers", i, late, failing, nWorkers)
+		}
+	}
+}
+
+func TestRunRandomReschedules(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 8)) // #nosec G404
+	for i := range 50 {
+		n := 2 + rng.IntN(30)
+		graph := randomGraph(rng, n, 0.1)
+		nWorkers := 1 + rng.IntN(6)
+		s := NewScheduler(graph)
+
+		// outstanding counts the runs of each task that have yet to finish.
+		// It's checked as tasks are admitted, as that's when they start as
+		// far as the scheduler's concerned.
+		var ordering sync.Mutex
+		requires := map[string][]string{}
+		outstanding := map[string]int{}
+		for dep, adj := range graph {
+			outstanding[dep]++
+			for _, v := range adj {
+				requires[v] = append(requires[v], dep)
+			}
+		}
+		s.Admit = func(name string, _ bool) bool {
+			ordering.Lock()
+			defer ordering.Unlock()
+			for _, dep := range requires[name] {
+				if outstanding[dep] > 0 {
+					t.Errorf("run %v: %v started before %v finished", i, name, dep)
+				}
+			}
+			return true
+		}
+
+		var mu sync.Mutex
+		added := 0
+		done := make(chan struct{})
+		var completed []string
+		var err error
+		go func() {
+			defer close(done)
+			completed, err = s.Run(context.Background(), nWorkers, func(name string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if rng.IntN(4) == 0 {
+					target := node(rng.IntN(n))
+					ok, err := s.Schedule(target, name)
+					if err != nil && !errors.Is(err, toposort.ErrCycleDetected) {
+						t.Errorf("run %v: %v", i, err)
+					}
+					ordering.Lock()
+					if err == nil && !slices.Contains(requires[target], name) {
+						requires[target] = append(requires[target], name)
+					}
+					if ok {
+						outstanding[target]++
+						added++
+					}
+					ordering.Unlock()
+				}
+				ordering.Lock()
+				outstanding[name]--
+				ordering.Unlock()
+				return nil
+			})
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("run %v: scheduler hung with %v workers", i, nWorkers)
+		}
+		if err != nil {
+			t.Fatalf("run %v: %v", i, err)
+		}
+		if len(completed) != n+added {
+			t.Fatalf("run %v: expected %v runs, got %v", i, n+added, len(completed))
+		}
+	}
+}
+
+var errFailed = errors.New("failed")
+
+func TestRunKeepGoing(t *testing.T) {
+	rng := rand.New(rand.NewPCG(9, 10)) // #nosec G404
+	for i := range 50 {
+		n := 2 + rng.IntN(30)
+		graph := randomGraph(rng, n, 0.1)
+		failing := map[string]bool{}
+		for range 1 + rng.IntN(3) {
+			failing[node(rng.IntN(n))] = true
+		}
+
+		// work out what should be blocked: everything depending on a
+		// failing task that isn't itself failing
+		expectBlocked := map[string]bool{}
+		stack := []string{}
+		for f := range failing {
+			stack = append(stack, graph[f]...)
+		}
+		for len(stack) > 0 {
+			dep := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if expectBlocked[dep] || failing[dep] {
+				continue
+			}
+			expectBlocked[dep] = true
+			stack = append(stack, graph[dep]...)
+		}
+
+		s := NewScheduler(graph)
+		s.KeepGoing = true
+		var mu sync.Mutex
+		blocked := map[string]bool{}
+		s.Blocked = func(name, failed string) {
+			mu.Lock()
+			defer mu.Unlock()
+			blocked[name] = true
+		}
+		completed, err := s.Run(context.Background(), 1+rng.IntN(4), func(name string) error {
+			if failing[name] {
+				return fmt.Errorf("%v: %w", name, errFailed)
+			}
+			return nil
+		})
+
+		// a failing task that's blocked by another never runs
+		ran := 0
+		for f := range failing {
+			if !blocked[f] {
+				ran++
+			}
+		}
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("run %v: expected the failures to be reported, got %v", i, err)
+		}
+		if got := strings.Count(err.Error(), errFailed.Error()); got != ran {
+			t.Fatalf("run %v: expected %v failures to be reported, got %v", i, ran, got)
+		}
+		for name := range expectBlocked {
+			if !failing[name] && !blocked[name] {
+				t.Fatalf("run %v: expected %v to be blocked", i, name)
+			}
+		}
+		if len(completed)+ran+len(blocked) != n {
+			t.Fatalf("run %v: %v completed, %v failed, and %v blocked out of %v", i, len(completed), ran, len(blocked), n)
+		}
+	}
+}
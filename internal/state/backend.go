@@ -0,0 +1,94 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+// Backend types.
+const (
+	BackendFile = "file"
+	BackendHTTP = "http"
+)
+
+// Backend stores state as a set of named objects, such as
+// `fingerprints.json` and `runs/<id>.json`, and arbitrates who may use it.
+type Backend interface {
+	// Read returns the contents of the named object. If there's no such
+	// object, the error wraps fs.ErrNotExist.
+	Read(name string) ([]byte, error)
+	// Write replaces the contents of the named object atomically.
+	Write(name string, data []byte) error
+	// List returns the names of the objects directly within a directory,
+	// such as `runs`, in lexical order.
+	List(dir string) ([]string, error)
+	// Lock locks the state against use by anyone else, failing with an
+	// error wrapping ErrLocked if someone else holds the lock.
+	Lock(info LockInfo) error
+	// Unlock releases the lock.
+	Unlock() error
+}
+
+// LockInfo describes who holds the lock on the state.
+type LockInfo struct {
+	ID      string    `json:"id"`
+	Who     string    `json:"who"`
+	PID     int       `json:"pid"`
+	Created time.Time `json:"created"`
+}
+
+// newLockInfo describes the current process as a lock holder.
+func newLockInfo(id string) LockInfo {
+	who := "unknown"
+	if u, err := user.Current(); err == nil {
+		who = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		who += "@" + host
+	}
+	return LockInfo{ID: id, Who: who, PID: os.Getpid(), Created: time.Now().UTC()}
+}
+
+func (l LockInfo) String() string {
+	return fmt.Sprintf("%v (process %v, since %v)", l.Who, l.PID, l.Created.Format(time.RFC3339))
+}
+
+// Config configures the state backend.
+type Config struct {
+	// Backend is the type of backend, defaulting to `file`.
+	Backend string `yaml:"backend,omitempty"`
+	// Path is the directory used by the file backend, relative to the
+	// configuration file. It defaults to `.sagan`.
+	Path string `yaml:"path,omitempty"`
+	// Address is the base URL used by the HTTP backend.
+	Address  string `yaml:"address,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// NewBackend creates the backend described by the configuration. Relative
+// paths are relative to base. Environment variables in the HTTP backend's
+// settings are expanded, so credentials needn't be kept in the
+// configuration file.
+func NewBackend(cfg Config, base string) (Backend, error) {
+	switch cfg.Backend {
+	case "", BackendFile:
+		path := cfg.Path
+		if path == "" {
+			path = ".sagan"
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(base, path)
+		}
+		return NewFileBackend(path), nil
+	case BackendHTTP:
+		return NewHTTPBackend(os.ExpandEnv(cfg.Address), os.ExpandEnv(cfg.Username), os.ExpandEnv(cfg.Password)), nil
+	default:
+		return nil, fmt.Errorf("%q: %w", cfg.Backend, common.ErrUnknownBackend)
+	}
+}
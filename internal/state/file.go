@@ -0,0 +1,97 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+// FileBackend keeps state in a local directory, locking it with a lock file
+// that's created exclusively.
+type FileBackend struct {
+	dir string
+}
+
+// NewFileBackend creates a FileBackend keeping state in dir, which is
+// created as needed.
+func NewFileBackend(dir string) *FileBackend {
+	return &FileBackend{dir: dir}
+}
+
+func (b *FileBackend) path(name string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(name))
+}
+
+func (b *FileBackend) Read(name string) ([]byte, error) {
+	return os.ReadFile(b.path(name)) // nolint:wrapcheck
+}
+
+func (b *FileBackend) Write(name string, data []byte) error {
+	path := b.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("could not write %v: %w", path, err)
+	}
+	return common.WriteFileAtomically(path, data, 0o644) // nolint:wrapcheck
+}
+
+func (b *FileBackend) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(b.path(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not list %v: %w", dir, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && entry.Name()[0] != '.' {
+			names = append(names, dir+"/"+entry.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (b *FileBackend) Lock(info LockInfo) error {
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return fmt.Errorf("could not create state directory: %w", err)
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("could not lock state: %w", err)
+	}
+
+	lock := b.path("lock")
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		holder := "someone else"
+		var current LockInfo
+		if data, err := os.ReadFile(lock); err == nil && json.Unmarshal(data, &current) == nil {
+			holder = current.String()
+		}
+		return fmt.Errorf("%w by %v: remove %v if it's no longer running", ErrLocked, holder, lock)
+	} else if err != nil {
+		return fmt.Errorf("could not lock state: %w", err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("could not lock state: %w", err)
+	}
+	return nil
+}
+
+func (b *FileBackend) Unlock() error {
+	if err := os.Remove(b.path("lock")); err != nil {
+		return fmt.Errorf("could not unlock state: %w", err)
+	}
+	return nil
+}
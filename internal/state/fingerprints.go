@@ -0,0 +1,91 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Fingerprints records the fingerprints of the fields watched by each task's
+// triggers as of the task's last successful run. It's safe for concurrent
+// use.
+type Fingerprints struct {
+	backend Backend
+	mu      sync.Mutex
+	tasks   map[string]map[string]string
+}
+
+const fingerprintsName = "fingerprints.json"
+
+// Change describes a watched field whose fingerprint differs from the one
+// recorded. An empty fingerprint means there was or is no value.
+type Change struct {
+	Key string
+	Old string
+	New string
+}
+
+type fingerprintsFile struct {
+	Version int                          `json:"version"`
+	Tasks   map[string]map[string]string `json:"tasks"`
+}
+
+// loadFingerprints reads the fingerprints recorded in a backend. If there
+// are none, nothing has been recorded yet.
+func loadFingerprints(backend Backend) (*Fingerprints, error) {
+	f := &Fingerprints{backend: backend, tasks: map[string]map[string]string{}}
+	data, err := backend.Read(fingerprintsName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read fingerprints: %w", err)
+	}
+	var contents fingerprintsFile
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("could not parse fingerprints: %w", err)
+	}
+	if contents.Version > SchemaVersion {
+		return nil, fmt.Errorf("fingerprints have version %v: %w", contents.Version, ErrSchemaVersion)
+	}
+	if contents.Tasks != nil {
+		f.tasks = contents.Tasks
+	}
+	return f, nil
+}
+
+// Changes compares the current fingerprints for a task against those
+// recorded, returning the changes sorted by key. If nothing has been
+// recorded for a field, it counts as changed.
+func (f *Fingerprints) Changes(task string, current map[string]string) []Change {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recorded := f.tasks[task]
+	changes := []Change{}
+	for _, key := range slices.Sorted(maps.Keys(current)) {
+		old, ok := recorded[key]
+		if !ok || old != current[key] {
+			changes = append(changes, Change{Key: key, Old: old, New: current[key]})
+		}
+	}
+	return changes
+}
+
+// Record stores the fingerprints for a task and saves them.
+func (f *Fingerprints) Record(task string, current map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tasks[task] = maps.Clone(current)
+
+	data, err := encode(fingerprintsFile{Version: SchemaVersion, Tasks: f.tasks})
+	if err != nil {
+		return fmt.Errorf("could not encode fingerprints: %w", err)
+	}
+	if err := f.backend.Write(fingerprintsName, data); err != nil {
+		return fmt.Errorf("could not save fingerprints: %w", err)
+	}
+	return nil
+}
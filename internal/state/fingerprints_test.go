@@ -0,0 +1,34 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFingerprintsRoundTrip(t *testing.T) {
+	backend := NewFileBackend(filepath.Join(t.TempDir(), ".sagan"))
+	f, err := loadFingerprints(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := map[string]string{"a.json#x": "1", "a.json#y": ""}
+	if changes := f.Changes("task", current); len(changes) != 2 {
+		t.Fatalf("expected every field to count as changed, got %v", changes)
+	}
+	if err := f.Record("task", current); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = loadFingerprints(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := f.Changes("task", current); len(changes) != 0 {
+		t.Fatalf("expected no changes, got %v", changes)
+	}
+	changes := f.Changes("task", map[string]string{"a.json#x": "2", "a.json#y": ""})
+	if len(changes) != 1 || changes[0] != (Change{Key: "a.json#x", Old: "1", New: "2"}) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+}
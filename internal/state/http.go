@@ -0,0 +1,167 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const httpTimeout = 30 * time.Second
+
+var ErrHTTPStatus = errors.New("unexpected HTTP status")
+
+// HTTPBackend keeps state on an HTTP server, in the spirit of Terraform's
+// http backend. Each object is stored at its name relative to the base
+// address: it's fetched with GET, where a 404 means it doesn't exist, and
+// stored with PUT. A GET of a directory's address with a trailing slash
+// must return a JSON array of the names of the objects in it.
+//
+// The state is locked with a LOCK request to the `lock` address and unlocked
+// with an UNLOCK request, both with the lock information as their body. If
+// the state is already locked, the server should respond to a LOCK request
+// with a 409 or 423 status and the current lock information.
+type HTTPBackend struct {
+	address  string
+	username string
+	password string
+	client   *http.Client
+
+	mu   sync.Mutex
+	lock *LockInfo
+}
+
+// NewHTTPBackend creates an HTTPBackend using the given base address and,
+// if a username is given, basic authentication.
+func NewHTTPBackend(address, username, password string) *HTTPBackend {
+	return &HTTPBackend{
+		address:  strings.TrimSuffix(address, "/"),
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: httpTimeout},
+	}
+}
+
+// do makes a request, returning the status and body of the response.
+func (b *HTTPBackend) do(method, name string, body []byte) (int, []byte, error) {
+	url := b.address + "/" + name
+	req, err := http.NewRequest(method, url, bytes.NewReader(body)) // nolint:noctx
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not make %v request to %v: %w", method, url, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if b.username != "" {
+		req.SetBasicAuth(b.username, b.password)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%v request to %v failed: %w", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("could not read response from %v: %w", url, err)
+	}
+	return resp.StatusCode, data, nil
+}
+
+// check turns an unsuccessful status into an error.
+func check(method, name string, status int) error {
+	switch {
+	case status == http.StatusNotFound:
+		return fmt.Errorf("%v: %w", name, fs.ErrNotExist)
+	case status < 200 || status > 299:
+		return fmt.Errorf("%v %v: %w %v", method, name, ErrHTTPStatus, status)
+	}
+	return nil
+}
+
+func (b *HTTPBackend) Read(name string) ([]byte, error) {
+	status, data, err := b.do(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := check(http.MethodGet, name, status); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (b *HTTPBackend) Write(name string, data []byte) error {
+	status, _, err := b.do(http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	return check(http.MethodPut, name, status)
+}
+
+func (b *HTTPBackend) List(dir string) ([]string, error) {
+	status, data, err := b.do(http.MethodGet, dir+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return []string{}, nil
+	}
+	if err := check(http.MethodGet, dir+"/", status); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, fmt.Errorf("could not parse listing of %v: %w", dir, err)
+	}
+	return names, nil
+}
+
+func (b *HTTPBackend) Lock(info LockInfo) error {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("could not lock state: %w", err)
+	}
+	status, data, err := b.do("LOCK", "lock", body)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusConflict || status == http.StatusLocked {
+		holder := "someone else"
+		var current LockInfo
+		if json.Unmarshal(data, &current) == nil && current.ID != "" {
+			holder = current.String()
+		}
+		return fmt.Errorf("%w by %v: unlock it on the server if it's no longer running", ErrLocked, holder)
+	}
+	if err := check("LOCK", "lock", status); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.lock = &info
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *HTTPBackend) Unlock() error {
+	b.mu.Lock()
+	lock := b.lock
+	b.lock = nil
+	b.mu.Unlock()
+	if lock == nil {
+		return nil
+	}
+	body, err := json.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("could not unlock state: %w", err)
+	}
+	status, _, err := b.do("UNLOCK", "lock", body)
+	if err != nil {
+		return err
+	}
+	return check("UNLOCK", "lock", status)
+}
@@ -0,0 +1,84 @@
+package state
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stateServer is a minimal server for the HTTP backend that keeps objects in
+// memory.
+type stateServer struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	lock    []byte
+}
+
+func (s *stateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "sagan" || pass != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/state/")
+	switch {
+	case r.Method == "LOCK" && name == "lock":
+		if s.lock != nil {
+			w.WriteHeader(http.StatusLocked)
+			w.Write(s.lock)
+			return
+		}
+		s.lock = body
+	case r.Method == "UNLOCK" && name == "lock":
+		s.lock = nil
+	case r.Method == http.MethodGet && strings.HasSuffix(name, "/"):
+		names := []string{}
+		for obj := range s.objects {
+			if strings.HasPrefix(obj, name) {
+				names = append(names, obj)
+			}
+		}
+		slices.Sort(names)
+		json.NewEncoder(w).Encode(names)
+	case r.Method == http.MethodGet:
+		data, ok := s.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodPut:
+		s.objects[name] = body
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPStore(t *testing.T) {
+	srv := httptest.NewServer(&stateServer{objects: map[string][]byte{}})
+	defer srv.Close()
+
+	testStore(t, func() Backend { return NewHTTPBackend(srv.URL+"/state/", "sagan", "secret") })
+}
+
+func TestHTTPBackendRejected(t *testing.T) {
+	srv := httptest.NewServer(&stateServer{objects: map[string][]byte{}})
+	defer srv.Close()
+
+	if _, err := Open(NewHTTPBackend(srv.URL+"/state", "sagan", "wrong")); err == nil {
+		t.Fatal("expected unauthorised requests to fail")
+	}
+}
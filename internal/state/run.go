@@ -0,0 +1,199 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+// Statuses of runs, tasks and stages.
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	// StatusSkipped is for stages whose paths already existed.
+	StatusSkipped = "skipped"
+	// StatusUnchanged is for tasks none of whose watched fields changed.
+	StatusUnchanged = "unchanged"
+	// StatusBlocked is for tasks that weren't run because a task they
+	// depend on failed.
+	StatusBlocked = "blocked"
+	// StatusInterrupted is for runs, tasks and stages that were stopped by
+	// a signal.
+	StatusInterrupted = "interrupted"
+)
+
+// Run is the record of a single invocation. It's saved whenever it's
+// updated, so it reflects how far the run got even if it was interrupted.
+type Run struct {
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	Config  string `json:"config"`
+	// ConfigHash is the hash of the parts of the configuration a run
+	// depends on, so it's only resumed if they haven't changed.
+	ConfigHash string `json:"config_hash,omitempty"`
+	// Resumes is the ID of the run this one picked up from, if any.
+	Resumes  string              `json:"resumes,omitempty"`
+	DryRun   bool                `json:"dry_run,omitempty"`
+	Status   string              `json:"status"`
+	Started  time.Time           `json:"started"`
+	Finished time.Time           `json:"finished,omitzero"`
+	Error    string              `json:"error,omitempty"`
+	Tasks    map[string]*TaskRun `json:"tasks"`
+
+	mu      sync.Mutex
+	backend Backend
+}
+
+// TaskRun records the most recent run of a task within a run.
+type TaskRun struct {
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started,omitzero"`
+	Finished time.Time `json:"finished,omitzero"`
+	Error    string    `json:"error,omitempty"`
+	// Runs counts how many times the task was run, as changes to the
+	// fields it watches can cause it to be run more than once.
+	Runs   int        `json:"runs,omitempty"`
+	Stages []StageRun `json:"stages,omitempty"`
+	// Fingerprints holds the fingerprints of the fields the task watches.
+	Fingerprints map[string]string `json:"fingerprints,omitempty"`
+	// Outputs holds the fingerprints of the fields the task's outputs
+	// changed.
+	Outputs map[string]string `json:"outputs,omitempty"`
+	Helpers []HelperRun       `json:"helpers,omitempty"`
+}
+
+// Done reports whether the task ran successfully, or didn't need to run.
+func (tr TaskRun) Done() bool {
+	return tr.Status == StatusSucceeded || tr.Status == StatusUnchanged
+}
+
+// FailedStage returns the stage the task failed or was interrupted at, if
+// any.
+func (tr TaskRun) FailedStage() string {
+	for _, stage := range tr.Stages {
+		if stage.Status == StatusFailed || stage.Status == StatusInterrupted {
+			return stage.Name
+		}
+	}
+	return ""
+}
+
+// StageRun records the run of a stage of a task's workflow.
+type StageRun struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started,omitzero"`
+	Finished time.Time `json:"finished,omitzero"`
+	// ExitCode is that of the command that failed, if any.
+	ExitCode int    `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Retries holds the failed attempts at running the stage or its
+	// commands that were retried.
+	Retries []RetryRun `json:"retries,omitempty"`
+}
+
+// RetryRun records a failed attempt that was retried.
+type RetryRun struct {
+	// Command is the position of the command that failed amongst its
+	// stage's commands, counting from 1, or 0 if the whole stage was
+	// retried.
+	Command int    `json:"command,omitempty"`
+	Attempt int    `json:"attempt"`
+	Error   string `json:"error"`
+}
+
+// HelperRun records a helper instance used by a task.
+type HelperRun struct {
+	Key  string            `json:"key"`
+	Name string            `json:"name"`
+	Type string            `json:"type"`
+	Args map[string]string `json:"args,omitempty"`
+	// PID is the process ID of a daemon helper.
+	PID int `json:"pid,omitempty"`
+	// Started is when the helper last produced its values.
+	Started time.Time `json:"started,omitzero"`
+}
+
+// UpdateTask applies fn to the record of the named task, creating it if
+// needed, and saves the run.
+func (r *Run) UpdateTask(name string, fn func(*TaskRun)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tr, ok := r.Tasks[name]
+	if !ok {
+		tr = &TaskRun{Status: StatusPending}
+		r.Tasks[name] = tr
+	}
+	fn(tr)
+	return r.save()
+}
+
+// Resume has the run pick up where a previous run left off: the records of
+// the tasks that succeeded in it are copied, and those tasks needn't be run
+// again. It's refused if the previous run was a dry run or was of a
+// configuration with a different hash, in which case the error wraps
+// ErrIncompatible.
+func (r *Run) Resume(prev *Run) error {
+	if prev.DryRun && !r.DryRun {
+		return fmt.Errorf("run %v was a dry run so can't be resumed", prev.ID) // nolint:err113
+	}
+	if prev.ConfigHash != r.ConfigHash {
+		return fmt.Errorf("can't resume run %v: %w", prev.ID, ErrIncompatible)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Resumes = prev.ID
+	for name, tr := range prev.Tasks {
+		if tr.Done() {
+			done := *tr
+			r.Tasks[name] = &done
+		}
+	}
+	return r.save()
+}
+
+// Task returns a copy of the record of the named task.
+func (r *Run) Task(name string) (TaskRun, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tr, ok := r.Tasks[name]
+	if !ok {
+		return TaskRun{}, false
+	}
+	return *tr, true
+}
+
+// Finish records the run as being over, with an error if it failed or was
+// interrupted, and saves it.
+func (r *Run) Finish(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = time.Now().UTC()
+	r.Status = StatusSucceeded
+	if err != nil {
+		r.Status = StatusFailed
+		if errors.Is(err, common.ErrInterrupted) {
+			r.Status = StatusInterrupted
+		}
+		r.Error = err.Error()
+	}
+	return r.save()
+}
+
+// save writes the run to the backend. The caller must hold r.mu.
+func (r *Run) save() error {
+	data, err := encode(r)
+	if err != nil {
+		return fmt.Errorf("could not encode run %v: %w", r.ID, err)
+	}
+	if err := r.backend.Write(runName(r.ID), data); err != nil {
+		return fmt.Errorf("could not save run %v: %w", r.ID, err)
+	}
+	return nil
+}
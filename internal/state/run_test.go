@@ -0,0 +1,54 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+func TestFinishStatus(t *testing.T) {
+	s, err := Open(NewFileBackend(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range []struct {
+		err    error
+		status string
+	}{
+		{nil, StatusSucceeded},
+		{errors.New("failed"), StatusFailed},
+		{fmt.Errorf("task a: %w", common.ErrInterrupted), StatusInterrupted},
+		{errors.Join(errors.New("failed"), common.ErrInterrupted), StatusInterrupted},
+	} {
+		run, err := s.NewRun("sagan.yaml", "hash", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := run.Finish(tc.err); err != nil {
+			t.Fatal(err)
+		}
+		if run.Status != tc.status {
+			t.Errorf("expected %v to give %v, got %v", tc.err, tc.status, run.Status)
+		}
+	}
+}
+
+func TestFailedStage(t *testing.T) {
+	for _, tc := range []struct {
+		stages   []StageRun
+		expected string
+	}{
+		{[]StageRun{{Name: "plan", Status: StatusSucceeded}}, ""},
+		{[]StageRun{{Name: "plan", Status: StatusSucceeded}, {Name: "apply", Status: StatusFailed}}, "apply"},
+		{[]StageRun{{Name: "plan", Status: StatusInterrupted}, {Name: "apply", Status: StatusSucceeded}}, "plan"},
+	} {
+		tr := TaskRun{Stages: tc.stages}
+		if stage := tr.FailedStage(); stage != tc.expected {
+			t.Errorf("expected %q for %+v, got %q", tc.expected, tc.stages, stage)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package state
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the format of the files in the state
+// directory. It's recorded in each file, and files with a later version
+// than this are refused.
+const SchemaVersion = 1
+
+var (
+	ErrLocked        = errors.New("state is locked")
+	ErrSchemaVersion = errors.New("unsupported state schema version")
+	ErrUnknownRun    = errors.New("unknown run")
+	ErrIncompatible  = errors.New("configuration has changed incompatibly")
+)
+
+// Store is the state kept between invocations in a backend, usually in a
+// `.sagan` directory alongside the configuration file. It's locked against
+// use by other invocations from when it's opened until it's closed.
+type Store struct {
+	backend Backend
+
+	fingerprints *Fingerprints
+}
+
+// Open opens the state kept in a backend and locks it. If another
+// invocation holds the lock, the error wraps ErrLocked.
+func Open(backend Backend) (*Store, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, fmt.Errorf("could not lock state: %w", err)
+	}
+	if err := backend.Lock(newLockInfo(id)); err != nil {
+		return nil, err // nolint:wrapcheck
+	}
+
+	s := &Store{backend: backend}
+	if s.fingerprints, err = loadFingerprints(backend); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close unlocks the state.
+func (s *Store) Close() error {
+	return s.backend.Unlock() // nolint:wrapcheck
+}
+
+// Fingerprints returns the fingerprints recorded for tasks' triggers.
+func (s *Store) Fingerprints() *Fingerprints {
+	return s.fingerprints
+}
+
+// NewRun starts recording a new run of the given configuration file, with
+// the configuration's hash as given by config.Config.Hash.
+func (s *Store) NewRun(config, configHash string, dryRun bool) (*Run, error) {
+	suffix, err := randomID()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate run ID: %w", err)
+	}
+	now := time.Now().UTC()
+	run := &Run{
+		Version:    SchemaVersion,
+		ID:         now.Format("20060102-150405") + "-" + suffix,
+		Config:     config,
+		ConfigHash: configHash,
+		DryRun:     dryRun,
+		Status:     StatusRunning,
+		Started:    now,
+		Tasks:      map[string]*TaskRun{},
+		backend:    s.backend,
+	}
+	if err := run.save(); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// LoadRun reads the record of a previous run.
+func (s *Store) LoadRun(id string) (*Run, error) {
+	data, err := s.backend.Read(runName(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%q: %w", id, ErrUnknownRun)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read run %v: %w", id, err)
+	}
+	run := &Run{}
+	if err := json.Unmarshal(data, run); err != nil {
+		return nil, fmt.Errorf("could not parse run %v: %w", id, err)
+	}
+	if run.Version > SchemaVersion {
+		return nil, fmt.Errorf("run %v has version %v: %w", id, run.Version, ErrSchemaVersion)
+	}
+	run.backend = s.backend
+	return run, nil
+}
+
+// Runs lists the IDs of the runs recorded, oldest first.
+func (s *Store) Runs() ([]string, error) {
+	names, err := s.backend.List("runs")
+	if err != nil {
+		return nil, fmt.Errorf("could not list runs: %w", err)
+	}
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		// run IDs start with a timestamp, so these are in order
+		if id, ok := strings.CutSuffix(path.Base(name), ".json"); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func runName(id string) string {
+	return "runs/" + id + ".json"
+}
+
+func randomID() (string, error) {
+	var id [3]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err // nolint:wrapcheck
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// encode encodes a state object as JSON.
+func encode(v any) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err // nolint:wrapcheck
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,100 @@
+package state
+
+import (
+	"errors"
+	"testing"
+)
+
+// testStore exercises a store kept in the backends made by newBackend, each
+// of which should share the same underlying state.
+func testStore(t *testing.T, newBackend func() Backend) {
+	t.Helper()
+
+	s, err := Open(newBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(newBackend()); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the state to be locked, got %v", err)
+	}
+
+	run, err := s.NewRun("sagan.yaml", "hash", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run.UpdateTask("a", func(tr *TaskRun) {
+		tr.Status = StatusFailed
+		tr.Stages = []StageRun{{Name: "apply", Status: StatusFailed, ExitCode: 2}}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.UpdateTask("b", func(tr *TaskRun) { tr.Status = StatusSucceeded }); err != nil {
+		t.Fatal(err)
+	}
+	if err := run.Finish(errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Fingerprints().Record("a", map[string]string{"a.json#x": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(newBackend())
+	if err != nil {
+		t.Fatalf("expected the state to be unlocked: %v", err)
+	}
+	defer s.Close()
+
+	ids, err := s.Runs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != run.ID {
+		t.Fatalf("unexpected runs: %v", ids)
+	}
+	loaded, err := s.LoadRun(run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Status != StatusFailed || loaded.Error != "failed" {
+		t.Fatalf("unexpected run status: %v %q", loaded.Status, loaded.Error)
+	}
+	tr, ok := loaded.Task("a")
+	if !ok || len(tr.Stages) != 1 || tr.Stages[0].ExitCode != 2 {
+		t.Fatalf("unexpected task record: %+v", tr)
+	}
+	if _, err := s.LoadRun("missing"); !errors.Is(err, ErrUnknownRun) {
+		t.Fatalf("expected an unknown run, got %v", err)
+	}
+	if changes := s.Fingerprints().Changes("a", map[string]string{"a.json#x": "1"}); len(changes) != 0 {
+		t.Fatalf("expected the fingerprints to have been kept, got %v", changes)
+	}
+
+	changed, err := s.NewRun("sagan.yaml", "changed", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := changed.Resume(loaded); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("expected the run to be incompatible, got %v", err)
+	}
+	resumed, err := s.NewRun("sagan.yaml", "hash", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.Resume(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resumed.Task("a"); ok {
+		t.Fatal("expected the failed task to be left to run again")
+	}
+	if tr, ok := resumed.Task("b"); !ok || tr.Status != StatusSucceeded || resumed.Resumes != run.ID {
+		t.Fatalf("expected the succeeded task to be carried over, got %+v", tr)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	testStore(t, func() Backend { return NewFileBackend(dir) })
+}
@@ -0,0 +1,97 @@
+package tfvars
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// DefaultSources are the patterns for the files loaded when a workflow
+// doesn't specify any.
+var DefaultSources = []string{"*.auto.tfvars.json", "terraform.tfvars.json"} // nolint:gochecknoglobals
+
+// Vars holds the variables loaded from a task's JSON variable files.
+type Vars struct {
+	// Values holds the variables from every file loaded, with those from
+	// files loaded later taking precedence.
+	Values map[string]any
+}
+
+// Load reads the JSON files in dir matching the given glob patterns. Files
+// are loaded in the order of the patterns that match them, and in lexical
+// order for files matching the same pattern. Each file must contain a JSON
+// object.
+func Load(dir string, patterns []string) (*Vars, error) {
+	vars := &Vars{Values: map[string]any{}}
+	loaded := map[string]bool{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+		}
+		slices.Sort(matches)
+		for _, match := range matches {
+			// a file matching several patterns is only loaded once
+			if loaded[match] {
+				continue
+			}
+			loaded[match] = true
+			contents, err := ReadFile(match)
+			if err != nil {
+				return nil, err
+			}
+			maps.Copy(vars.Values, contents)
+		}
+	}
+	return vars, nil
+}
+
+// Sourced reports whether the file at path is one Load would read from dir
+// given the same patterns.
+func Sourced(dir string, patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if ok, err := filepath.Match(filepath.Join(dir, pattern), path); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFile reads a JSON file containing an object.
+func ReadFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %v: %w", path, err)
+	}
+	contents := map[string]any{}
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("could not parse %v: %w", path, err)
+	}
+	return contents, nil
+}
+
+// Environment returns the variables as environment variables. Strings are
+// given as is, while other values are given as JSON.
+func (v *Vars) Environment() map[string]string {
+	env := map[string]string{}
+	for name, val := range v.Values {
+		env[name] = Format(val)
+	}
+	return env
+}
+
+// Format renders a value for use in an environment variable: strings are
+// given as is, while other values are given as JSON.
+func Format(val any) string {
+	if s, ok := val.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprint(val)
+	}
+	return string(data)
+}
@@ -0,0 +1,94 @@
+package tfvars
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"b.auto.tfvars.json":    `{"zone": "b", "b": true}`,
+		"a.auto.tfvars.json":    `{"zone": "a", "a": 1}`,
+		"terraform.tfvars.json": `{"zone": "main", "tags": {"x": "y"}}`,
+		"ignored.json":          `{"zone": "ignored"}`,
+	})
+
+	// the last pattern matches a file already loaded, so it isn't reloaded
+	vars, err := Load(dir, []string{"*.auto.tfvars.json", "terraform.tfvars.json", "a.*.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := vars.Environment()
+	expected := map[string]string{
+		"zone": "main",
+		"a":    "1",
+		"b":    "true",
+		"tags": `{"x":"y"}`,
+	}
+	if len(env) != len(expected) {
+		t.Errorf("unexpected variables: %v", env)
+	}
+	for name, val := range expected {
+		if env[name] != val {
+			t.Errorf("expected %v to be %q, got %q", name, val, env[name])
+		}
+	}
+
+	vars, err = Load(dir, []string{"terraform.tfvars.json", "*.auto.tfvars.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars.Values["zone"] != "b" {
+		t.Errorf("expected files matching later patterns to take precedence, got %v", vars.Values["zone"])
+	}
+
+	if vars, err := Load(dir, []string{"*.missing.json"}); err != nil || len(vars.Values) != 0 {
+		t.Errorf("expected nothing to be loaded, got %v, %v", vars, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"broken.auto.tfvars.json": `{"zone": `,
+		"list.auto.tfvars.json":   `["zone"]`,
+	})
+
+	for _, name := range []string{"broken.auto.tfvars.json", "list.auto.tfvars.json"} {
+		_, err := Load(dir, []string{name})
+		if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, name)) {
+			t.Errorf("expected an error naming %v, got %v", name, err)
+		}
+	}
+
+	if _, err := Load(dir, []string{"[.json"}); err == nil || !strings.Contains(err.Error(), `"[.json"`) {
+		t.Errorf("expected an error naming the pattern, got %v", err)
+	}
+}
+
+func TestSourced(t *testing.T) {
+	patterns := []string{"*.auto.tfvars.json", "terraform.tfvars.json"}
+	for path, expected := range map[string]bool{
+		"/work/a.auto.tfvars.json":      true,
+		"/work/terraform.tfvars.json":   true,
+		"/work/other.json":              false,
+		"/elsewhere/a.auto.tfvars.json": false,
+		"/work/sub/a.auto.tfvars.json":  false,
+	} {
+		if Sourced("/work", patterns, path) != expected {
+			t.Errorf("expected %v to be sourced: %v", path, expected)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package tfvars
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/kgaughan/sagan/internal/common"
+)
+
+// Output actions.
+const (
+	// ActionReplace overwrites the value of a field.
+	ActionReplace = "replace"
+	// ActionAdd adds to the value of a field: items are appended to lists
+	// that don't already contain them, and fields are merged into objects.
+	ActionAdd = "add"
+)
+
+var (
+	ErrNotObject = errors.New("expected a JSON object")
+	ErrCannotAdd = errors.New("can only add to lists and objects")
+)
+
+// Writer updates fields in JSON variable files. Updates to the same file are
+// serialised, so it can be shared between tasks running in parallel.
+type Writer struct {
+	mu    sync.Mutex
+	files map[string]*sync.Mutex
+}
+
+// NewWriter creates a Writer.
+func NewWriter() *Writer {
+	return &Writer{files: map[string]*sync.Mutex{}}
+}
+
+// lock locks the file at path against concurrent updates, returning a function
+// to unlock it.
+func (w *Writer) lock(path string) func() {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	w.mu.Lock()
+	mu, ok := w.files[path]
+	if !ok {
+		mu = &sync.Mutex{}
+		w.files[path] = mu
+	}
+	w.mu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Apply updates a field of the JSON object in the file at path using the
+// given action, creating the file if it doesn't exist. The file is replaced
+// atomically. The order of the object's fields and the formatting of the
+// values of fields other than the one being updated are preserved. It
+// returns the field's resulting value and reports whether the file's contents
+// changed.
+func (w *Writer) Apply(path, action, field string, value any) (any, bool, error) {
+	unlock := w.lock(path)
+	defer unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, fmt.Errorf("could not read %v: %w", path, err)
+	}
+	obj, err := parseObject(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not parse %v: %w", path, err)
+	}
+
+	existing, found := obj.get(field)
+	var updated any
+	switch action {
+	case ActionReplace:
+		updated = value
+	case ActionAdd:
+		if updated, err = add(existing, found, value); err != nil {
+			return nil, false, fmt.Errorf("could not add to %q in %v: %w", field, path, err)
+		}
+	default:
+		return nil, false, fmt.Errorf("%q: %w", action, common.ErrUnknownAction)
+	}
+	if found && reflect.DeepEqual(existing, updated) {
+		return existing, false, nil
+	}
+
+	raw, err := json.Marshal(updated)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not encode %q: %w", field, err)
+	}
+	obj.set(field, raw)
+
+	if err := common.WriteFileAtomically(path, obj.encode(), 0o644); err != nil {
+		return nil, false, err
+	}
+	return updated, true, nil
+}
+
+// add works out the result of adding value to a field's existing value.
+func add(existing any, found bool, value any) (any, error) {
+	if !found || existing == nil {
+		return value, nil
+	}
+	switch current := existing.(type) {
+	case []any:
+		items := []any{value}
+		if list, ok := value.([]any); ok {
+			items = list
+		}
+		result := slices.Clone(current)
+		for _, item := range items {
+			present := false
+			for _, have := range result {
+				if reflect.DeepEqual(have, item) {
+					present = true
+					break
+				}
+			}
+			if !present {
+				result = append(result, item)
+			}
+		}
+		return result, nil
+	case map[string]any:
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return nil, ErrCannotAdd
+		}
+		result := maps.Clone(current)
+		maps.Copy(result, fields)
+		return result, nil
+	default:
+		return nil, ErrCannotAdd
+	}
+}
+
+// object is a JSON object that remembers the order of its fields and the
+// exact encoding of their values.
+type object struct {
+	keys   []string
+	values map[string]json.RawMessage
+	// fresh tracks the values that have been set rather than parsed.
+	fresh  map[string]bool
+	indent string
+	// trailer is whatever followed the object in the file.
+	trailer string
+}
+
+func parseObject(data []byte) (*object, error) {
+	obj := &object{
+		values:  map[string]json.RawMessage{},
+		fresh:   map[string]bool{},
+		indent:  detectIndent(data),
+		trailer: "\n",
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return obj, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err // nolint:wrapcheck
+	} else if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, ErrNotObject
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err // nolint:wrapcheck
+		}
+		key, _ := tok.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err // nolint:wrapcheck
+		}
+		obj.keys = append(obj.keys, key)
+		obj.values[key] = raw
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err // nolint:wrapcheck
+	}
+	if rest := data[dec.InputOffset():]; len(bytes.TrimSpace(rest)) == 0 {
+		obj.trailer = string(rest)
+	}
+	return obj, nil
+}
+
+// detectIndent works out the indentation used by a JSON file, defaulting to
+// two spaces.
+func detectIndent(data []byte) string {
+	for line := range strings.SplitSeq(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && len(trimmed) < len(line) {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "  "
+}
+
+func (o *object) get(key string) (any, bool) {
+	raw, ok := o.values[key]
+	if !ok {
+		return nil, false
+	}
+	var val any
+	if err := json.Unmarshal(raw, &val); err != nil {
+		return nil, false
+	}
+	return val, true
+}
+
+func (o *object) set(key string, raw json.RawMessage) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = raw
+	o.fresh[key] = true
+}
+
+func (o *object) encode() []byte {
+	var buf bytes.Buffer
+	if len(o.keys) == 0 {
+		buf.WriteString("{}")
+		buf.WriteString(o.trailer)
+		return buf.Bytes()
+	}
+	buf.WriteString("{\n")
+	for i, key := range o.keys {
+		name, _ := json.Marshal(key)
+		buf.WriteString(o.indent)
+		buf.Write(name)
+		buf.WriteString(": ")
+		raw := o.values[key]
+		if o.fresh[key] {
+			// freshly encoded values need to be indented to fit in
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, raw, o.indent, o.indent); err == nil {
+				raw = indented.Bytes()
+			}
+		}
+		buf.Write(raw)
+		if i < len(o.keys)-1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('}')
+	buf.WriteString(o.trailer)
+	return buf.Bytes()
+}
@@ -0,0 +1,72 @@
+package tfvars
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyPreservesLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "terraform.tfvars.json")
+	original := "{\n    \"zone\": \"eu\",\n    \"tags\": {\"a\": 1},\n    \"name\": \"old\"\n}\n"
+	if err := os.WriteFile(path, []byte(original), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWriter()
+	_, changed, err := w.Apply(path, ActionReplace, "name", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected the file to change")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\n    \"zone\": \"eu\",\n    \"tags\": {\"a\": 1},\n    \"name\": \"new\"\n}\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected contents:\n%s", data)
+	}
+
+	if _, changed, err := w.Apply(path, ActionReplace, "name", "new"); err != nil {
+		t.Fatal(err)
+	} else if changed {
+		t.Fatal("expected no change when the value is the same")
+	}
+}
+
+func TestApplyAdd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "terraform.tfvars.json")
+
+	w := NewWriter()
+	var updated any
+	for _, value := range []any{"a", "b", "a"} {
+		var err error
+		if updated, _, err = w.Apply(path, ActionAdd, "items", []any{value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vars, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, ok := vars["items"].([]any)
+	if !ok || len(items) != 2 || items[0] != "a" || items[1] != "b" {
+		t.Fatalf("unexpected items: %v", vars["items"])
+	}
+	if !reflect.DeepEqual(updated, vars["items"]) {
+		t.Fatalf("expected the resulting value, got %v", updated)
+	}
+
+	if _, _, err := w.Apply(path, ActionReplace, "name", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := w.Apply(path, ActionAdd, "name", "y"); err == nil {
+		t.Fatal("expected an error adding to a string")
+	}
+}